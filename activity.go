@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How often user activity is checked.
+	activityCheckPeriod = 5 * time.Second
+)
+
+var (
+	// User without activity for awayTimeout is marked away.
+	awayTimeout = 5 * time.Minute
+	// User without activity for idleTimeout is disconnected, zero disables it.
+	idleTimeout time.Duration
+)
+
+// parseActivityTimeouts reads AWAY_TIMEOUT and IDLE_TIMEOUT durations, e.g. `10m`.
+// Empty values keep defaults
+func parseActivityTimeouts(away string, idle string) error {
+	if away != "" {
+		timeout, err := time.ParseDuration(away)
+		if err != nil {
+			return err
+		}
+		awayTimeout = timeout
+	}
+	if idle != "" {
+		timeout, err := time.ParseDuration(idle)
+		if err != nil {
+			return err
+		}
+		idleTimeout = timeout
+	}
+	return nil
+}
+
+// Touch marks user as active now
+func (u *User) Touch() {
+	atomic.StoreInt64(&u.lastActive, time.Now().UnixNano())
+}
+
+// Idle returns time since the last user activity
+func (u *User) Idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&u.lastActive)))
+}
+
+// setAway changes away status and broadcasts user_update if it changed
+func (u *User) setAway(away bool) {
+	u.infoLock.Lock()
+	changed := u.info.Away != away
+	u.info.Away = away
+	u.infoLock.Unlock()
+	if changed && !u.Room().IsWaiting(u) {
+		u.BroadcastEventUpdate()
+	}
+}
+
+// watchActivity marks user away and disconnects idle user
+func (u *User) watchActivity() {
+	ticker := time.NewTicker(activityCheckPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		if u.stop {
+			return
+		}
+		idle := u.Idle()
+		if idleTimeout > 0 && idle >= idleTimeout {
+			u.log("disconnecting idle user")
+			u.Kick("idle timeout")
+			return
+		}
+		u.setAway(awayTimeout > 0 && idle >= awayTimeout)
+	}
+}
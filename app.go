@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+const (
+	// Maximum app event namespace length.
+	maxAppNamespaceLength = 64
+	// Maximum app event payload size in bytes.
+	maxAppPayloadSize = 16384
+)
+
+var errInvalidAppEvent = errors.New("app event needs namespace and payload up to 16KB")
+
+// AppEvent is a custom event of client application, e.g. a timer or a dice roll
+type AppEvent struct {
+	Namespace string          `json:"namespace"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	From      *UserWrap       `json:"from,omitempty"` // sender, set by server
+}
+
+// AppHandler handles app events of a namespace on the server.
+// Returned event is relayed to everyone in the room, nil relays nothing.
+// Handler can answer sender directly with user.SendEvent
+type AppHandler interface {
+	HandleApp(user *User, event *AppEvent) (*AppEvent, error)
+}
+
+// AppHandlerFunc lets ordinary functions be app handlers
+type AppHandlerFunc func(user *User, event *AppEvent) (*AppEvent, error)
+
+// HandleApp calls f(user, event)
+func (f AppHandlerFunc) HandleApp(user *User, event *AppEvent) (*AppEvent, error) {
+	return f(user, event)
+}
+
+var appHandlers = make(map[string]AppHandler)
+
+// RegisterAppHandler sets handler for app events of the namespace.
+// Events of namespaces without handler are relayed as is.
+// Handlers should be registered before server starts
+func RegisterAppHandler(namespace string, handler AppHandler) {
+	appHandlers[namespace] = handler
+}
+
+// HandleApp passes app event to the handler of its namespace and relays the result to the room
+func (u *User) HandleApp(event *AppEvent) error {
+	if event == nil || event.Namespace == "" || len(event.Namespace) > maxAppNamespaceLength || len(event.Payload) > maxAppPayloadSize {
+		return errInvalidAppEvent
+	}
+	if !u.CanChat() {
+		return errForbidden
+	}
+	if !u.signalLimiter.Allow() {
+		return errRateLimited
+	}
+	event.From = u.Wrap()
+	if handler, exists := appHandlers[event.Namespace]; exists {
+		var err error
+		event, err = handler.HandleApp(u, event)
+		if err != nil {
+			return err
+		}
+		if event == nil {
+			return nil
+		}
+	}
+	return u.Room().BroadcastEvent(Event{Type: "app", App: event}, nil)
+}
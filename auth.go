@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // register hashes used by token algorithms
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	errNoToken        = errors.New("no token")
+	errInvalidToken   = errors.New("invalid token")
+	errTokenExpired   = errors.New("token is expired")
+	errNoExpiration   = errors.New("token has no expiration")
+	errRoomNotAllowed = errors.New("room is not allowed")
+	errAuthRequired   = errors.New("auth is not configured")
+)
+
+// tokenSubprotocol is the websocket subprotocol followed by the token itself,
+// browsers can not set headers on websocket connections
+const tokenSubprotocol = "access_token"
+
+// Claims are JWT claims used to identify user
+type Claims struct {
+	Subject     string   `json:"sub"`                   // user identity in the application
+	Name        string   `json:"name,omitempty"`        // display name
+	Rooms       []string `json:"rooms,omitempty"`       // allowed rooms, any room if empty
+	Role        string   `json:"role,omitempty"`        // moderator or user
+	Permissions []string `json:"permissions,omitempty"` // overrides room default permissions
+	ExpiresAt   int64    `json:"exp"`                   // required, tokens never expiring are rejected
+	NotBefore   int64    `json:"nbf,omitempty"`
+}
+
+// CanJoin reports whether claims allow to join the room
+func (c *Claims) CanJoin(roomID string) bool {
+	if len(c.Rooms) == 0 {
+		return true
+	}
+	for _, room := range c.Rooms {
+		if room == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// Auth verifies JWT tokens signed with HMAC secret or RSA key
+type Auth struct {
+	secret    []byte
+	publicKey *rsa.PublicKey
+}
+
+// NewAuthFromEnv configures auth from JWT_SECRET (HMAC secret)
+// and JWT_PUBLIC_KEY (path to PEM encoded RSA public key).
+// Returns nil if neither is set, then everyone is allowed to connect
+func NewAuthFromEnv() (*Auth, error) {
+	auth := &Auth{}
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		auth.secret = []byte(secret)
+	}
+	if path := os.Getenv("JWT_PUBLIC_KEY"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		auth.publicKey, err = parseRSAPublicKey(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if auth.secret == nil && auth.publicKey == nil {
+		return nil, nil
+	}
+	return auth, nil
+}
+
+func parseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no pem block in public key")
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not rsa")
+	}
+	return rsaKey, nil
+}
+
+// Verify checks token signature and expiration and returns its claims
+func (a *Auth) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+	headerRaw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerRaw, &header); err != nil {
+		return nil, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	if err := a.verifySignature(header.Alg, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	claimsRaw, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(claimsRaw, &claims); err != nil {
+		return nil, errInvalidToken
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, errNoExpiration
+	}
+	now := time.Now().Unix()
+	if now >= claims.ExpiresAt {
+		return nil, errTokenExpired
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, errInvalidToken
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return &claims, nil
+}
+
+// verifySignature checks signature with the key matching alg.
+// Algorithms without configured key are rejected, including "none"
+func (a *Auth) verifySignature(alg string, signed []byte, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "HS256", "RS256":
+		hash = crypto.SHA256
+	case "HS384", "RS384":
+		hash = crypto.SHA384
+	case "HS512", "RS512":
+		hash = crypto.SHA512
+	default:
+		return errInvalidToken
+	}
+
+	if strings.HasPrefix(alg, "HS") {
+		if a.secret == nil {
+			return errInvalidToken
+		}
+		mac := hmac.New(hash.New, a.secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errInvalidToken
+		}
+		return nil
+	}
+
+	if a.publicKey == nil {
+		return errInvalidToken
+	}
+	hasher := hash.New()
+	hasher.Write(signed)
+	if err := rsa.VerifyPKCS1v15(a.publicKey, hash, hasher.Sum(nil), signature); err != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+// TokenFromRequest extracts token from `token` query parameter,
+// `access_token, <token>` websocket subprotocols or Authorization header
+func TokenFromRequest(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	protocols := websocket.Subprotocols(r)
+	for i, protocol := range protocols {
+		if protocol == tokenSubprotocol && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	return ""
+}
+
+// Authenticate verifies token passed with request
+func (a *Auth) Authenticate(r *http.Request) (*Claims, error) {
+	token := TokenFromRequest(r)
+	if token == "" {
+		return nil, errNoToken
+	}
+	return a.Verify(token)
+}
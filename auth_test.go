@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("test secret")
+
+func encodeSegment(t *testing.T, value interface{}) string {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// signHS256 makes token with header alg and HS256 signature
+func signHS256(t *testing.T, alg string, claims map[string]interface{}) string {
+	signed := encodeSegment(t, map[string]string{"alg": alg, "typ": "JWT"}) + "." + encodeSegment(t, claims)
+	mac := hmac.New(sha256.New, testSecret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	signed := encodeSegment(t, map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + encodeSegment(t, claims)
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestAuthVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacAuth := &Auth{secret: testSecret}
+	rsaAuth := &Auth{publicKey: &key.PublicKey}
+
+	now := time.Now().Unix()
+	valid := map[string]interface{}{"sub": "alice", "exp": now + 60}
+	with := func(changes map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{}
+		for name, value := range valid {
+			claims[name] = value
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+	unsigned := encodeSegment(t, map[string]string{"alg": "none"}) + "." + encodeSegment(t, valid) + "."
+	tampered := signHS256(t, "HS256", valid)
+	tampered = tampered[:len(tampered)-2] + "AA"
+
+	tests := []struct {
+		name  string
+		auth  *Auth
+		token string
+		err   error
+	}{
+		{"valid hmac", hmacAuth, signHS256(t, "HS256", valid), nil},
+		{"valid rsa", rsaAuth, signRS256(t, key, valid), nil},
+		{"bad signature", hmacAuth, tampered, errInvalidToken},
+		{"rsa signed by other key", rsaAuth, signRS256(t, otherKey, valid), errInvalidToken},
+		{"alg none", hmacAuth, unsigned, errInvalidToken},
+		{"hmac without secret", rsaAuth, signHS256(t, "HS256", valid), errInvalidToken},
+		{"rsa without key", hmacAuth, signRS256(t, key, valid), errInvalidToken},
+		{"alg does not match signature", hmacAuth, signHS256(t, "HS512", valid), errInvalidToken},
+		{"no exp", hmacAuth, signHS256(t, "HS256", with(map[string]interface{}{"exp": nil})), errNoExpiration},
+		{"expired", hmacAuth, signHS256(t, "HS256", with(map[string]interface{}{"exp": now - 1})), errTokenExpired},
+		{"not yet valid", hmacAuth, signHS256(t, "HS256", with(map[string]interface{}{"nbf": now + 60})), errInvalidToken},
+		{"already valid", hmacAuth, signHS256(t, "HS256", with(map[string]interface{}{"nbf": now - 60})), nil},
+		{"malformed", hmacAuth, "not.a.token", errInvalidToken},
+		{"two parts", hmacAuth, "header.claims", errInvalidToken},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := test.auth.Verify(test.token)
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if err == nil && claims.Subject != "alice" {
+				t.Fatalf("got subject %q", claims.Subject)
+			}
+		})
+	}
+
+	t.Run("empty sub", func(t *testing.T) {
+		if _, err := hmacAuth.Verify(signHS256(t, "HS256", with(map[string]interface{}{"sub": ""}))); err == nil {
+			t.Fatal("token without subject is accepted")
+		}
+	})
+}
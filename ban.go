@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	errBanned  = errors.New("banned from the room")
+	errLocked  = errors.New("room is locked")
+	errBanSelf = errors.New("ban would match yourself")
+)
+
+// Ban is an entry of room ban list. Either identity or ip is set
+type Ban struct {
+	Identity string `json:"identity,omitempty"`
+	IP       string `json:"ip,omitempty"`
+}
+
+func (b Ban) matches(identity string, ip string) bool {
+	return (b.Identity != "" && b.Identity == identity) || (b.IP != "" && b.IP == ip)
+}
+
+// IsLocked reports whether new users can not join the room
+func (r *Room) IsLocked() bool {
+	r.infoLock.RLock()
+	defer r.infoLock.RUnlock()
+	return r.locked
+}
+
+// SetLocked locks or unlocks the room and broadcasts room_update event
+func (r *Room) SetLocked(locked bool) error {
+	r.infoLock.Lock()
+	r.locked = locked
+	r.infoLock.Unlock()
+	return r.BroadcastEvent(Event{Type: "room_update", Room: r.Wrap(nil)}, nil)
+}
+
+// IsBanned reports whether user with identity or ip is banned in the room
+func (r *Room) IsBanned(identity string, ip string) bool {
+	r.infoLock.RLock()
+	defer r.infoLock.RUnlock()
+	for _, ban := range r.bans {
+		if ban.matches(identity, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddBan adds entry to room ban list and kicks out everyone it matches,
+// including users of breakout rooms and the lobby. Moderators are not kicked
+// by ip bans, they can share the address with others behind the same NAT
+func (r *Room) AddBan(ban Ban) {
+	r.infoLock.Lock()
+	r.bans = append(r.bans, ban)
+	r.infoLock.Unlock()
+
+	for _, room := range append([]*Room{r}, r.GetBreakouts()...) {
+		for _, user := range append(room.GetUsers(), room.GetLobbyUsers()...) {
+			ip := user.ip
+			if user.IsModerator() {
+				ip = ""
+			}
+			if ban.matches(user.identity, ip) {
+				user.Kick(errBanned.Error())
+			}
+		}
+	}
+}
+
+// RemoveBan removes entry from room ban list
+func (r *Room) RemoveBan(ban Ban) {
+	r.infoLock.Lock()
+	defer r.infoLock.Unlock()
+	bans := []Ban{}
+	for _, b := range r.bans {
+		if b != ban {
+			bans = append(bans, b)
+		}
+	}
+	r.bans = bans
+}
+
+// HandleLock locks or unlocks the room. Requires change_room permission
+func (u *User) HandleLock(locked bool) error {
+	if !u.CanChangeRoom() {
+		return errForbidden
+	}
+	return u.Room().Main().SetLocked(locked)
+}
+
+// HandleBan bans target user by identity, or by ip for anonymous users.
+// Ban entry can also be given explicitly. Only moderators can ban
+func (u *User) HandleBan(targetID string, ban *Ban) error {
+	if !u.IsModerator() {
+		return errForbidden
+	}
+	room := u.Room().Main()
+	if targetID != "" {
+		target, err := room.FindUser(targetID)
+		if err != nil {
+			return err
+		}
+		if target.identity != "" {
+			ban = &Ban{Identity: target.identity}
+		} else {
+			ban = &Ban{IP: target.ip}
+		}
+	}
+	if ban == nil || (ban.Identity == "" && ban.IP == "") {
+		return errors.New("empty ban")
+	}
+	if ban.matches(u.identity, u.ip) {
+		return errBanSelf
+	}
+	room.AddBan(*ban)
+	return nil
+}
+
+// HandleUnban removes ban entry. Only moderators can unban
+func (u *User) HandleUnban(ban *Ban) error {
+	if !u.IsModerator() {
+		return errForbidden
+	}
+	if ban == nil {
+		return errors.New("empty ban")
+	}
+	u.Room().Main().RemoveBan(*ban)
+	return nil
+}
+
+// FindUser looks for user in the room, its breakout rooms and the lobby
+func (r *Room) FindUser(userID string) (*User, error) {
+	for _, room := range append([]*Room{r}, r.GetBreakouts()...) {
+		if user, err := room.GetUser(userID); err == nil {
+			return user, nil
+		}
+		for _, user := range room.GetLobbyUsers() {
+			if user.ID == userID {
+				return user, nil
+			}
+		}
+	}
+	return nil, errNotFound
+}
+
+// trustedProxies are networks of reverse proxies whose X-Forwarded-For is honoured
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies reads TRUSTED_PROXIES, comma separated ips or cidrs
+func parseTrustedProxies(value string) error {
+	trustedProxies = nil
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return err
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	return nil
+}
+
+func isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns client ip. X-Forwarded-For is used only when request
+// comes from a trusted proxy, the client is the last address not of a trusted proxy
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(forwarded[i])
+		if address == "" {
+			continue
+		}
+		if !isTrustedProxy(address) {
+			return address
+		}
+		host = address
+	}
+	return host
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	defer parseTrustedProxies("")
+	tests := []struct {
+		value    string
+		networks int
+		err      bool
+	}{
+		{"", 0, false},
+		{"10.0.0.1", 1, false},
+		{" 10.0.0.0/8 , 192.168.1.1,", 2, false},
+		{"::1, fd00::/8", 2, false},
+		{"10.0.0.0/33", 0, true},
+		{"proxy.local", 0, true},
+	}
+	for _, test := range tests {
+		err := parseTrustedProxies(test.value)
+		if (err != nil) != test.err {
+			t.Errorf("%q: got error %v", test.value, err)
+			continue
+		}
+		if err == nil && len(trustedProxies) != test.networks {
+			t.Errorf("%q: got %d networks, want %d", test.value, len(trustedProxies), test.networks)
+		}
+	}
+	if err := parseTrustedProxies("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if isTrustedProxy("10.0.0.2") || !isTrustedProxy("10.0.0.1") {
+		t.Error("single ip matches as a network")
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	defer parseTrustedProxies("")
+	tests := []struct {
+		name      string
+		proxies   string
+		addr      string
+		forwarded string
+		ip        string
+	}{
+		{"no proxies", "", "1.2.3.4:5000", "", "1.2.3.4"},
+		{"forwarded ignored without proxies", "", "1.2.3.4:5000", "5.6.7.8", "1.2.3.4"},
+		{"forwarded from untrusted address", "10.0.0.0/8", "1.2.3.4:5000", "5.6.7.8", "1.2.3.4"},
+		{"trusted proxy", "10.0.0.0/8", "10.0.0.1:5000", "5.6.7.8", "5.6.7.8"},
+		{"spoofed address before client", "10.0.0.0/8", "10.0.0.1:5000", "9.9.9.9, 5.6.7.8", "5.6.7.8"},
+		{"chain of trusted proxies", "10.0.0.0/8", "10.0.0.1:5000", "9.9.9.9, 5.6.7.8, 10.0.0.2", "5.6.7.8"},
+		{"trusted proxy without header", "10.0.0.0/8", "10.0.0.1:5000", "", "10.0.0.1"},
+		{"only trusted addresses", "10.0.0.0/8", "10.0.0.1:5000", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"ipv6", "::1", "[::1]:5000", "2001:db8::1", "2001:db8::1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := parseTrustedProxies(test.proxies); err != nil {
+				t.Fatal(err)
+			}
+			r := &http.Request{RemoteAddr: test.addr, Header: http.Header{}}
+			if test.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", test.forwarded)
+			}
+			if ip := remoteIP(r); ip != test.ip {
+				t.Fatalf("got %s, want %s", ip, test.ip)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+var errNoBreakouts = errors.New("room has no breakout rooms")
+
+// BreakoutsConfig describes how to split room participants into breakout rooms
+type BreakoutsConfig struct {
+	Rooms    map[string][]string `json:"rooms,omitempty"`    // breakout room name to user ids
+	Random   int                 `json:"random,omitempty"`   // split everyone except moderators into this many rooms
+	Duration int                 `json:"duration,omitempty"` // seconds until everyone returns to the main room
+}
+
+// GetBreakouts returns breakout rooms of the room
+func (r *Room) GetBreakouts() []*Room {
+	r.breakoutsLock.Lock()
+	defer r.breakoutsLock.Unlock()
+	rooms := []*Room{}
+	for _, room := range r.breakouts {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// Main returns main room for breakout rooms and the room itself otherwise
+func (r *Room) Main() *Room {
+	if r.parent != nil {
+		return r.parent
+	}
+	return r
+}
+
+// OpenBreakouts creates breakout rooms and moves users there
+func (r *Room) OpenBreakouts(config BreakoutsConfig) error {
+	assignment := config.Rooms
+	if config.Random > 0 {
+		assignment = make(map[string][]string)
+		users := []*User{}
+		for _, user := range r.GetUsers() {
+			if !user.IsModerator() {
+				users = append(users, user)
+			}
+		}
+		rand.Shuffle(len(users), func(i, j int) { users[i], users[j] = users[j], users[i] })
+		for i, user := range users {
+			name := strconv.Itoa(i%config.Random + 1)
+			assignment[name] = append(assignment[name], user.ID)
+		}
+	}
+	if len(assignment) == 0 {
+		return errors.New("no breakout rooms given")
+	}
+
+	r.breakoutsLock.Lock()
+	if len(r.breakouts) > 0 {
+		r.breakoutsLock.Unlock()
+		return errors.New("breakout rooms are already open")
+	}
+	r.breakouts = make(map[string]*Room)
+	moves := make(map[*User]*Room)
+	for name, userIDs := range assignment {
+		options := r.options
+		options.Lobby = false
+		breakout := NewRoom(r.Name+"/"+name, options)
+		breakout.parent = r
+		breakout.presence = r.presence
+		breakout.invites = r.invites
+		breakout.chatLog = r.chatLog
+		breakout.LoadChatHistory()
+		go breakout.run()
+		r.breakouts[name] = breakout
+		for _, userID := range userIDs {
+			user, err := r.GetUser(userID)
+			if err != nil {
+				continue
+			}
+			moves[user] = breakout
+		}
+	}
+	if config.Duration > 0 {
+		r.breakoutTimer = time.AfterFunc(time.Duration(config.Duration)*time.Second, func() {
+			if err := r.CloseBreakouts(); err != nil {
+				r.log(err)
+			}
+		})
+	}
+	r.breakoutsLock.Unlock()
+
+	for user, breakout := range moves {
+		user.MoveTo(breakout)
+	}
+	return nil
+}
+
+// CloseBreakouts brings everyone back to the main room
+func (r *Room) CloseBreakouts() error {
+	r.breakoutsLock.Lock()
+	breakouts := r.breakouts
+	r.breakouts = nil
+	if r.breakoutTimer != nil {
+		r.breakoutTimer.Stop()
+		r.breakoutTimer = nil
+	}
+	r.breakoutsLock.Unlock()
+
+	if len(breakouts) == 0 {
+		return errNoBreakouts
+	}
+	for _, breakout := range breakouts {
+		// users still moving to the breakout may join it meanwhile, bring them back too
+		for !breakout.CloseIfEmpty() {
+			for _, user := range breakout.GetUsers() {
+				user.MoveTo(r)
+			}
+		}
+	}
+	return nil
+}
+
+// MoveTo moves user to another room on the same peer connection.
+// User tracks are detached from the old room and attached to the new one.
+// If the room is closed meanwhile, user goes to its main room
+func (u *User) MoveTo(room *Room) {
+	u.moveLock.Lock()
+	defer u.moveLock.Unlock()
+	ssrcs := u.GetInTrackSSRCs()
+	if u.CanPublish() {
+		u.unpublishTracks(ssrcs)
+	}
+	u.detachRoomTracks()
+	u.Room().Detach(u)
+
+	u.setRoom(room)
+	if err := room.Join(u); err != nil {
+		room = room.Main()
+		u.setRoom(room)
+		if err := room.Join(u); err != nil {
+			u.log(err)
+			return
+		}
+	}
+	if u.CanPublish() {
+		u.publishTracks(ssrcs)
+	}
+	if err := u.attachRoomTracks(); err != nil {
+		u.log(err)
+	}
+	u.SendEventRoom()
+}
+
+// detachRoomTracks removes all room tracks from user peer connection
+func (u *User) detachRoomTracks() {
+	for _, sender := range u.pc.GetSenders() {
+		if sender.Track() == nil {
+			continue
+		}
+		if err := u.pc.RemoveTrack(sender); err != nil {
+			u.log(err)
+		}
+	}
+	u.outTracksLock.Lock()
+	for ssrc := range u.outTracks {
+		delete(u.outTracks, ssrc)
+	}
+	u.outTracksLock.Unlock()
+}
+
+// attachRoomTracks adds tracks of other room speakers to user peer connection and renegotiates
+func (u *User) attachRoomTracks() error {
+	for _, user := range u.Room().GetOtherUsers(u) {
+		if !user.CanPublish() {
+			continue
+		}
+		for _, ssrc := range user.GetInTrackSSRCs() {
+			if err := u.AddTrack(ssrc); err != nil {
+				return err
+			}
+		}
+	}
+	return u.SendOffer()
+}
+
+// HandleOpenBreakouts splits main room into breakout rooms. Only moderators can do that
+func (u *User) HandleOpenBreakouts(config *BreakoutsConfig) error {
+	if !u.IsModerator() {
+		return errForbidden
+	}
+	if config == nil {
+		return errors.New("empty breakouts")
+	}
+	return u.Room().Main().OpenBreakouts(*config)
+}
+
+// HandleCloseBreakouts returns everyone to the main room. Only moderators can do that
+func (u *User) HandleCloseBreakouts() error {
+	if !u.IsModerator() {
+		return errForbidden
+	}
+	return u.Room().Main().CloseBreakouts()
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// Chat messages kept per room and sent to new users.
+	maxChatHistory = 100
+	// Maximum chat message length in characters.
+	maxChatMessageLength = 2000
+	// Chat messages allowed per second after burst is spent.
+	chatRate = 1
+	// Chat messages user can send at once.
+	chatBurst = 10
+)
+
+// Message is a chat message
+type Message struct {
+	ID   string    `json:"id"`
+	User *UserWrap `json:"user,omitempty"` // author, set by server
+	Text string    `json:"text"`
+	Time int64     `json:"time"`         // unix milliseconds, set by server
+	To   string    `json:"to,omitempty"` // recipient id of direct message
+
+	Edited  int64 `json:"edited,omitempty"`  // unix milliseconds of the last edit
+	Deleted bool  `json:"deleted,omitempty"` // deletion record in chat log
+}
+
+var (
+	errUserNotFound    = errors.New("user_not_found")
+	errMessageNotFound = errors.New("message_not_found")
+)
+
+// AddChatMessage appends message to room history, dropping the oldest one if full,
+// and writes it to chat log
+func (r *Room) AddChatMessage(message *Message) {
+	r.chatLock.Lock()
+	r.chat = append(r.chat, message)
+	if len(r.chat) > maxChatHistory {
+		r.chat = r.chat[len(r.chat)-maxChatHistory:]
+	}
+	r.chatLock.Unlock()
+	if err := r.chatLog.Append(r.Name, message); err != nil {
+		r.log("chat log: ", err)
+	}
+}
+
+// GetChatMessage returns message from recent room history,
+// older messages are looked up in chat log
+func (r *Room) GetChatMessage(messageID string) (*Message, error) {
+	r.chatLock.RLock()
+	for _, message := range r.chat {
+		if message.ID == messageID {
+			r.chatLock.RUnlock()
+			return message, nil
+		}
+	}
+	r.chatLock.RUnlock()
+	return r.chatLog.Get(r.Name, messageID)
+}
+
+// ReplaceChatMessage swaps message in room history with edited one, or removes it
+// if the message is deleted, and writes the change to chat log.
+// Messages older than room history are changed only in the log
+func (r *Room) ReplaceChatMessage(message *Message) error {
+	r.chatLock.Lock()
+	found := false
+	for i, existing := range r.chat {
+		if existing.ID != message.ID {
+			continue
+		}
+		if message.Deleted {
+			r.chat = append(r.chat[:i:i], r.chat[i+1:]...)
+		} else {
+			r.chat[i] = message
+		}
+		found = true
+		break
+	}
+	r.chatLock.Unlock()
+	var err error
+	if message.Deleted {
+		err = r.chatLog.Remove(r.Name, message.ID)
+	} else {
+		err = r.chatLog.Append(r.Name, message)
+	}
+	if err == errMessageNotFound && !found {
+		return err
+	}
+	if err != nil && err != errMessageNotFound {
+		r.log("chat log: ", err)
+	}
+	return nil
+}
+
+// LoadChatHistory fills room history with the latest messages from chat log
+func (r *Room) LoadChatHistory() {
+	messages, err := r.chatLog.Read(r.Name, "", maxChatHistory)
+	if err != nil {
+		r.log("chat log: ", err)
+		return
+	}
+	r.chatLock.Lock()
+	defer r.chatLock.Unlock()
+	r.chat = messages
+}
+
+// GetChatHistory returns recent chat messages, oldest first
+func (r *Room) GetChatHistory() []*Message {
+	r.chatLock.RLock()
+	defer r.chatLock.RUnlock()
+	messages := make([]*Message, len(r.chat))
+	copy(messages, r.chat)
+	return messages
+}
+
+// newMessage checks that user can send message and validates it
+func (u *User) newMessage(message *Message, to string) (*Message, error) {
+	if !u.CanChat() {
+		return nil, errForbidden
+	}
+	if !u.chatLimiter.Allow() {
+		return nil, errRateLimited
+	}
+	if message == nil {
+		return nil, errors.New("empty message")
+	}
+	text, err := validateMessageText(message.Text)
+	if err != nil {
+		return nil, err
+	}
+	newMessage := &Message{
+		ID:   newID(),
+		User: u.Wrap(),
+		Text: text,
+		Time: time.Now().UnixNano() / int64(time.Millisecond),
+		To:   to,
+	}
+	if err := u.filterMessage(newMessage); err != nil {
+		return nil, err
+	}
+	return newMessage, nil
+}
+
+func validateMessageText(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", errors.New("empty message")
+	}
+	if utf8.RuneCountInString(text) > maxChatMessageLength {
+		return "", fmt.Errorf("message is longer than %d characters", maxChatMessageLength)
+	}
+	return text, nil
+}
+
+// isAuthor tells if author is this user, in this or another session
+func (u *User) isAuthor(author *UserWrap) bool {
+	if author == nil {
+		return false
+	}
+	return author.ID == u.ID || (u.identity != "" && author.Identity == u.identity)
+}
+
+// canChangeMessage tells if user is the author of message or a moderator
+func (u *User) canChangeMessage(message *Message) bool {
+	return u.IsModerator() || u.isAuthor(message.User)
+}
+
+// HandleChat sends chat message to everyone in the room, including author
+func (u *User) HandleChat(message *Message) error {
+	chatMessage, err := u.newMessage(message, "")
+	if err != nil {
+		return err
+	}
+	u.Room().AddChatMessage(chatMessage)
+	return u.Room().BroadcastEvent(Event{Type: "chat", Message: chatMessage}, nil)
+}
+
+// HandleDirectMessage delivers message only to target user of the room
+// and acknowledges delivery to the author
+func (u *User) HandleDirectMessage(targetID string, message *Message) error {
+	target, err := u.Room().GetUser(targetID)
+	if err != nil || target.ID == u.ID {
+		return errUserNotFound
+	}
+	directMessage, err := u.newMessage(message, target.ID)
+	if err != nil {
+		return err
+	}
+	if err := target.SendEvent(Event{Type: "direct_message", Message: directMessage}); err != nil {
+		return err
+	}
+	return u.SendEvent(Event{Type: "direct_message_delivered", Message: directMessage})
+}
+
+// HandleEditMessage changes text of a chat message.
+// Authors can edit their own messages, moderators any message
+func (u *User) HandleEditMessage(message *Message) error {
+	if message == nil {
+		return errMessageNotFound
+	}
+	original, err := u.Room().GetChatMessage(message.ID)
+	if err != nil {
+		return err
+	}
+	if !u.canChangeMessage(original) {
+		return errForbidden
+	}
+	if !u.chatLimiter.Allow() {
+		return errRateLimited
+	}
+	text, err := validateMessageText(message.Text)
+	if err != nil {
+		return err
+	}
+	edited := *original
+	edited.Text = text
+	edited.Edited = time.Now().UnixNano() / int64(time.Millisecond)
+	if err := u.filterMessage(&edited); err != nil {
+		return err
+	}
+	if err := u.Room().ReplaceChatMessage(&edited); err != nil {
+		return err
+	}
+	return u.Room().BroadcastEvent(Event{Type: "edit_message", Message: &edited}, nil)
+}
+
+// HandleDeleteMessage removes a chat message.
+// Authors can delete their own messages, moderators any message
+func (u *User) HandleDeleteMessage(message *Message) error {
+	if message == nil {
+		return errMessageNotFound
+	}
+	original, err := u.Room().GetChatMessage(message.ID)
+	if err != nil {
+		return err
+	}
+	if !u.canChangeMessage(original) {
+		return errForbidden
+	}
+	deleted := &Message{ID: original.ID, Time: original.Time, Deleted: true}
+	if err := u.Room().ReplaceChatMessage(deleted); err != nil {
+		return err
+	}
+	return u.Room().BroadcastEvent(Event{Type: "delete_message", Message: deleted}, nil)
+}
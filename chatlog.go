@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// Messages returned by history api when limit is not set.
+	defaultChatPageSize = 50
+	// Maximum messages returned by history api at once.
+	maxChatPageSize = 200
+	// Maximum size of a single chat log line in bytes.
+	maxChatLogLine = 1 << 20
+)
+
+// dataDir is where chat logs and other room data are kept, `DATA_DIR` env
+var dataDir = "data"
+
+// ChatLog appends chat messages to a file per room, so that chat
+// outlives rooms and restarts of the server
+type ChatLog struct {
+	dir   string
+	rooms map[string]*chatLogIndex // only rooms with a log file
+	lock  sync.Mutex
+}
+
+// chatLogIndex keeps where every message of room log is, so that pages
+// are read without parsing the whole file. Built on first use of the log
+type chatLogIndex struct {
+	loaded    bool
+	ids       []string // in order of first appearance in the log
+	positions map[string]int
+	entries   map[string]chatLogEntry // latest version of every message
+	lock      sync.RWMutex            // guards index and log file
+}
+
+type chatLogEntry struct {
+	offset int64
+	length int64 // without line break
+}
+
+// NewChatLog creates chat log in the directory
+func NewChatLog(dir string) (*ChatLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &ChatLog{dir: dir, rooms: make(map[string]*chatLogIndex)}, nil
+}
+
+// room returns index of room log, so that rooms do not wait for each other.
+// Unless create is set, returns nil if room has no log,
+// rooms are not tracked just because someone asked for them
+func (l *ChatLog) room(roomID string, create bool) *chatLogIndex {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	index, exists := l.rooms[roomID]
+	if exists {
+		return index
+	}
+	if !create {
+		if _, err := os.Stat(l.path(roomID)); err != nil {
+			return nil
+		}
+	}
+	index = &chatLogIndex{}
+	l.rooms[roomID] = index
+	return index
+}
+
+func (l *ChatLog) path(roomID string) string {
+	return filepath.Join(l.dir, url.PathEscape(roomID)+".jsonl")
+}
+
+// reset clears index, entries are added in order of the log
+func (index *chatLogIndex) reset() {
+	index.loaded = true
+	index.ids = []string{}
+	index.positions = make(map[string]int)
+	index.entries = make(map[string]chatLogEntry)
+}
+
+// add records message line at offset, a later version replaces the earlier one
+func (index *chatLogIndex) add(messageID string, entry chatLogEntry) {
+	if _, exists := index.positions[messageID]; !exists {
+		index.positions[messageID] = len(index.ids)
+		index.ids = append(index.ids, messageID)
+	}
+	index.entries[messageID] = entry
+}
+
+// scanChatLog calls fn with every message of the log, its line and where the line is
+func scanChatLog(file *os.File, fn func(message *Message, line []byte, entry chatLogEntry)) error {
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxChatLogLine)
+	var offset int64
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		entry := chatLogEntry{offset: offset, length: int64(len(line))}
+		offset += int64(len(line)) + 1
+		message := &Message{}
+		if err := json.Unmarshal(line, message); err != nil {
+			continue
+		}
+		fn(message, line, entry)
+	}
+	return scanner.Err()
+}
+
+// load builds index from the log file once, caller holds write lock
+func (index *chatLogIndex) load(path string) error {
+	if index.loaded {
+		return nil
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		index.reset()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	index.reset()
+	err = scanChatLog(file, func(message *Message, line []byte, entry chatLogEntry) {
+		index.add(message.ID, entry)
+	})
+	if err != nil {
+		index.loaded = false
+	}
+	return err
+}
+
+// Append writes message to the end of room log
+func (l *ChatLog) Append(roomID string, message *Message) error {
+	if l == nil {
+		return nil
+	}
+	line, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	index := l.room(roomID, true)
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	path := l.path(roomID)
+	if err := index.load(path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	index.add(message.ID, chatLogEntry{offset: info.Size(), length: int64(len(line))})
+	return file.Close()
+}
+
+// Get returns the latest version of message from room log
+func (l *ChatLog) Get(roomID string, messageID string) (*Message, error) {
+	if l == nil {
+		return nil, errMessageNotFound
+	}
+	index := l.room(roomID, false)
+	if index == nil {
+		return nil, errMessageNotFound
+	}
+	var message *Message
+	err := l.view(index, roomID, func(file *os.File) (err error) {
+		message, err = index.message(file, messageID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if message == nil || message.Deleted {
+		return nil, errMessageNotFound
+	}
+	return message, nil
+}
+
+// Remove deletes every version of the message from room log by rewriting it,
+// so that deleted text does not stay on disk
+func (l *ChatLog) Remove(roomID string, messageID string) error {
+	if l == nil {
+		return nil
+	}
+	index := l.room(roomID, false)
+	if index == nil {
+		return errMessageNotFound
+	}
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	path := l.path(roomID)
+	if err := index.load(path); err != nil {
+		return err
+	}
+	if _, exists := index.entries[messageID]; !exists {
+		return errMessageNotFound
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	out, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(out)
+	var offset int64
+	ids := []string{}
+	entries := make(map[string]chatLogEntry)
+	err = scanChatLog(file, func(message *Message, line []byte, entry chatLogEntry) {
+		if message.ID == messageID {
+			return
+		}
+		writer.Write(line)
+		writer.WriteByte('\n')
+		if _, exists := entries[message.ID]; !exists {
+			ids = append(ids, message.ID)
+		}
+		entries[message.ID] = chatLogEntry{offset: offset, length: entry.length}
+		offset += entry.length + 1
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	index.reset()
+	for _, id := range ids {
+		index.add(id, entries[id])
+	}
+	return nil
+}
+
+// Read returns at most limit latest messages sent before the message
+// with id before, oldest first. Empty before means the latest messages.
+// Edits and deletions later in the log are applied to their messages
+func (l *ChatLog) Read(roomID string, before string, limit int) ([]*Message, error) {
+	messages := []*Message{}
+	if l == nil {
+		return messages, nil
+	}
+	index := l.room(roomID, false)
+	if index == nil {
+		if before != "" {
+			return nil, errMessageNotFound
+		}
+		return messages, nil
+	}
+	err := l.view(index, roomID, func(file *os.File) error {
+		end := len(index.ids)
+		if before != "" {
+			position, exists := index.positions[before]
+			if !exists {
+				return errMessageNotFound
+			}
+			end = position
+		}
+		for i := end - 1; i >= 0 && len(messages) < limit; i-- {
+			message, err := index.message(file, index.ids[i])
+			if err != nil {
+				return err
+			}
+			if message != nil && !message.Deleted {
+				messages = append(messages, message)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// view loads index if needed and calls fn with the log file under read lock
+func (l *ChatLog) view(index *chatLogIndex, roomID string, fn func(file *os.File) error) error {
+	path := l.path(roomID)
+	index.lock.Lock()
+	err := index.load(path)
+	index.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return fn(file)
+}
+
+// message reads the latest version of message from the log, nil if it is not there
+func (index *chatLogIndex) message(file *os.File, messageID string) (*Message, error) {
+	entry, exists := index.entries[messageID]
+	if !exists {
+		return nil, nil
+	}
+	line := make([]byte, entry.length)
+	if _, err := file.ReadAt(line, entry.offset); err != nil {
+		return nil, err
+	}
+	message := &Message{}
+	if err := json.Unmarshal(line, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
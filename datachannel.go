@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v2"
+)
+
+const (
+	// Ordered channel with retransmissions, for game state and commands.
+	relayReliable = "reliable"
+	// Unordered channel without retransmissions, for cursors and other frequent updates.
+	relayUnreliable = "unreliable"
+	// Maximum relayed data channel message size in bytes.
+	maxRelayMessageSize = 16384
+	// Data channel messages allowed per second after burst is spent.
+	relayRate = 30
+	// Data channel messages user can send at once.
+	relayBurst = 60
+)
+
+var errInvalidRelayMessage = errors.New("data channel message must be json text")
+
+// RelayMessage is a data channel message relayed between participants.
+// Clients send data with optional recipients, server adds sender id
+type RelayMessage struct {
+	From string          `json:"from,omitempty"` // sender id, set by server
+	To   []string        `json:"to,omitempty"`   // recipient ids, everyone else in the room if empty
+	Data json.RawMessage `json:"data"`
+}
+
+// relayMode returns relay mode matching data channel reliability
+func relayMode(dc *webrtc.DataChannel) string {
+	if dc.Ordered() && dc.MaxRetransmits() == nil && dc.MaxPacketLifeTime() == nil {
+		return relayReliable
+	}
+	return relayUnreliable
+}
+
+// HandleDataChannel relays messages of data channel opened by client.
+// The channel is also used to deliver messages of other users in the same mode
+func (u *User) HandleDataChannel(dc *webrtc.DataChannel) {
+	mode := relayMode(dc)
+	u.log("data channel ", dc.Label(), " opened in ", mode, " mode")
+
+	u.dataChannelsLock.Lock()
+	u.dataChannels[mode] = dc
+	u.dataChannelsLock.Unlock()
+
+	dc.OnClose(func() {
+		u.dataChannelsLock.Lock()
+		if u.dataChannels[mode] == dc {
+			delete(u.dataChannels, mode)
+		}
+		u.dataChannelsLock.Unlock()
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if err := u.relayDataChannelMessage(mode, msg); err != nil {
+			u.log("relay data channel message: ", err)
+		}
+	})
+}
+
+func (u *User) relayDataChannelMessage(mode string, msg webrtc.DataChannelMessage) error {
+	if !u.CanChat() {
+		return errForbidden
+	}
+	if !u.relayLimiter.Allow() {
+		return errRateLimited
+	}
+	if !msg.IsString || len(msg.Data) > maxRelayMessageSize {
+		return errInvalidRelayMessage
+	}
+	var message RelayMessage
+	if err := json.Unmarshal(msg.Data, &message); err != nil {
+		return errInvalidRelayMessage
+	}
+	recipients := u.Room().GetOtherUsers(u)
+	if len(message.To) > 0 {
+		recipients = []*User{}
+		added := make(map[string]bool)
+		for _, id := range message.To {
+			if added[id] {
+				continue
+			}
+			added[id] = true
+			if user, err := u.Room().GetUser(id); err == nil && user.ID != u.ID {
+				recipients = append(recipients, user)
+			}
+		}
+	}
+
+	data, err := json.Marshal(RelayMessage{From: u.ID, Data: message.Data})
+	if err != nil {
+		return err
+	}
+	undelivered := []string{}
+	for _, user := range recipients {
+		dc, err := user.ensureDataChannel(mode)
+		if err != nil {
+			u.log(err)
+		}
+		if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+			undelivered = append(undelivered, user.ID)
+			continue
+		}
+		if err := dc.SendText(string(data)); err != nil {
+			u.log(err)
+			undelivered = append(undelivered, user.ID)
+		}
+	}
+	// losing messages is expected in unreliable mode
+	if mode == relayReliable && len(undelivered) > 0 {
+		return u.SendErr(fmt.Errorf("data channel message not delivered to %s, their channel is not open yet", strings.Join(undelivered, ", ")))
+	}
+	return nil
+}
+
+// ensureDataChannel returns user data channel of the mode. If user has not opened one,
+// server opens it and renegotiates, the channel is not usable until that completes
+func (u *User) ensureDataChannel(mode string) (*webrtc.DataChannel, error) {
+	u.dataChannelsLock.RLock()
+	dc := u.dataChannels[mode]
+	u.dataChannelsLock.RUnlock()
+	if dc != nil {
+		return dc, nil
+	}
+
+	options := &webrtc.DataChannelInit{}
+	if mode == relayUnreliable {
+		ordered := false
+		maxRetransmits := uint16(0)
+		options.Ordered = &ordered
+		options.MaxRetransmits = &maxRetransmits
+	}
+	u.dataChannelsLock.Lock()
+	if existing := u.dataChannels[mode]; existing != nil {
+		u.dataChannelsLock.Unlock()
+		return existing, nil
+	}
+	dc, err := u.pc.CreateDataChannel("relay-"+mode, options)
+	if err != nil {
+		u.dataChannelsLock.Unlock()
+		return nil, err
+	}
+	u.dataChannels[mode] = dc
+	u.dataChannelsLock.Unlock()
+	u.HandleDataChannel(dc)
+	u.log("data channel ", dc.Label(), " created by server")
+	if dc.ReadyState() == webrtc.DataChannelStateOpen {
+		return dc, nil
+	}
+	return dc, u.SendOffer()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Maximum uploaded file size in bytes, `MAX_FILE_SIZE` env.
+	maxFileSize int64 = 10 << 20
+	// Maximum size of all files of a room in bytes, `MAX_ROOM_FILES_SIZE` env.
+	maxRoomFilesSize int64 = 100 << 20
+	// Content types allowed for upload, detected from file contents.
+	allowedFileTypes = map[string]bool{
+		"image/png":       true,
+		"image/jpeg":      true,
+		"image/gif":       true,
+		"image/webp":      true,
+		"application/pdf": true,
+		"text/plain":      true,
+	}
+)
+
+var (
+	errFileTooLarge = errors.New("file is too large")
+	errRoomQuota    = errors.New("room has no space left for files")
+	errFileType     = errors.New("file type is not allowed")
+)
+
+// File is a file shared in the room
+type File struct {
+	ID   string    `json:"id"`
+	Name string    `json:"name"`
+	Type string    `json:"type"`
+	Size int64     `json:"size"`
+	URL  string    `json:"url"` // download url, add `?secret=<session secret>` of a room member
+	User *UserWrap `json:"user"`
+	Time int64     `json:"time"` // unix milliseconds
+}
+
+// Files keeps uploaded files on disk, in a directory per room.
+// Files are removed together with their room
+type Files struct {
+	dir   string
+	files map[string]map[string]*File // room id to file id to file
+	used  map[string]int64            // bytes of room files, including uploads in progress
+	lock  sync.RWMutex
+}
+
+// NewFiles creates files storage in the directory.
+// Rooms do not survive restarts, so files left from previous run are removed
+func NewFiles(dir string) (*Files, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Files{dir: dir, files: make(map[string]map[string]*File), used: make(map[string]int64)}, nil
+}
+
+func (f *Files) roomDir(roomID string) string {
+	return filepath.Join(f.dir, url.PathEscape(roomID))
+}
+
+// reserve takes space for upload from room quota, returns how many bytes can be written
+func (f *Files) reserve(roomID string) (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	allowance := maxRoomFilesSize - f.used[roomID]
+	if allowance <= 0 {
+		return 0, errRoomQuota
+	}
+	if allowance > maxFileSize {
+		allowance = maxFileSize
+	}
+	f.used[roomID] += allowance
+	return allowance, nil
+}
+
+// Save stores file uploaded by user to the room.
+// File type is detected from contents and must be one of allowedFileTypes.
+// Files of a room take at most maxRoomFilesSize bytes
+func (f *Files) Save(roomID string, user *User, name string, body io.Reader) (*File, error) {
+	allowance, err := f.reserve(roomID)
+	if err != nil {
+		return nil, err
+	}
+	saved := int64(0)
+	defer func() {
+		f.lock.Lock()
+		// room may be removed meanwhile
+		if used := f.used[roomID] + saved - allowance; used > 0 {
+			f.used[roomID] = used
+		} else {
+			delete(f.used, roomID)
+		}
+		f.lock.Unlock()
+	}()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(body, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+	fileType := strings.Split(http.DetectContentType(head), ";")[0]
+	if !allowedFileTypes[fileType] {
+		return nil, errFileType
+	}
+
+	file := &File{
+		ID:   newID(),
+		Name: filepath.Base(name),
+		Type: fileType,
+		URL:  "/api/rooms/" + url.PathEscape(roomID) + "/files/",
+		User: user.Wrap(),
+		Time: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	file.URL += file.ID
+	if err := os.MkdirAll(f.roomDir(roomID), 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(f.roomDir(roomID), file.ID)
+	out, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(out, io.LimitReader(io.MultiReader(bytes.NewReader(head), body), allowance+1))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && size > maxFileSize {
+		err = errFileTooLarge
+	} else if err == nil && size > allowance {
+		err = errRoomQuota
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	file.Size = size
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	saved = size
+	if f.files[roomID] == nil {
+		f.files[roomID] = make(map[string]*File)
+	}
+	f.files[roomID][file.ID] = file
+	return file, nil
+}
+
+// Get returns file of the room and path to its contents
+func (f *Files) Get(roomID string, fileID string) (*File, string, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	file, exists := f.files[roomID][fileID]
+	if !exists {
+		return nil, "", errNotFound
+	}
+	return file, filepath.Join(f.roomDir(roomID), file.ID), nil
+}
+
+// RemoveRoom deletes all files of the room
+func (f *Files) RemoveRoom(roomID string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.files, roomID)
+	delete(f.used, roomID)
+	return os.RemoveAll(f.roomDir(roomID))
+}
+
+// FindMember finds user who joined the room or one of its breakout rooms
+// by session secret. Users waiting in the lobby are not members
+func (r *Room) FindMember(secret string) (*User, error) {
+	if secret == "" {
+		return nil, errNotFound
+	}
+	for _, room := range append([]*Room{r}, r.GetBreakouts()...) {
+		for _, user := range room.GetUsers() {
+			if subtle.ConstantTimeCompare([]byte(user.secret), []byte(secret)) == 1 {
+				return user, nil
+			}
+		}
+	}
+	return nil, errNotFound
+}
+
+// ShareFile tells everyone in user's room about uploaded file
+func (u *User) ShareFile(file *File) error {
+	return u.Room().BroadcastEvent(Event{Type: "file", File: file}, nil)
+}
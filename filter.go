@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// FilterVerdict is a decision of content filter about a message
+type FilterVerdict int
+
+const (
+	filterAllow  FilterVerdict = iota
+	filterRedact               // message is sent with text replaced
+	filterFlag                 // message is sent and moderators are notified
+	filterReject               // message is not sent
+)
+
+var errMessageRejected = errors.New("message rejected by content filter")
+
+// FilterResult is returned by content filter for every message
+type FilterResult struct {
+	Verdict FilterVerdict
+	Text    string // new text of redacted message
+	Reason  string // why message is flagged or rejected
+}
+
+// ContentFilter checks chat messages before they are sent to others.
+// Filters run in order of registration, each one sees text redacted by previous ones
+type ContentFilter interface {
+	Filter(user *User, message *Message) FilterResult
+}
+
+var contentFilters []ContentFilter
+
+// RegisterContentFilter adds filter for all chat messages and edits.
+// Filters should be registered before server starts
+func RegisterContentFilter(filter ContentFilter) {
+	contentFilters = append(contentFilters, filter)
+}
+
+// filterMessage runs content filters over message, redacting its text in place.
+// Moderators get `message_flagged` event for flagged messages, except direct ones
+// which are only for their recipient
+func (u *User) filterMessage(message *Message) error {
+	reasons := []string{}
+	for _, filter := range contentFilters {
+		result := filter.Filter(u, message)
+		switch result.Verdict {
+		case filterReject:
+			u.log("message rejected: ", result.Reason)
+			return errMessageRejected
+		case filterRedact:
+			message.Text = result.Text
+		case filterFlag:
+			reasons = append(reasons, result.Reason)
+		}
+	}
+	if len(reasons) > 0 && message.To != "" {
+		u.log("direct message flagged: ", strings.Join(reasons, ", "))
+		return nil
+	}
+	if len(reasons) > 0 {
+		u.Room().SendEventModerators(Event{Type: "message_flagged", Message: message, Desc: strings.Join(reasons, ", ")})
+	}
+	return nil
+}
+
+// WordlistFilter catches messages containing any of the listed words, case insensitive
+type WordlistFilter struct {
+	words   map[string]bool
+	verdict FilterVerdict
+}
+
+// ParseWordlistFilter creates filter from comma separated words, `CHAT_WORDLIST` env,
+// and action applied to matching messages: redact (default), flag or reject.
+// Returns nil if there are no words
+func ParseWordlistFilter(wordlist string, action string) (*WordlistFilter, error) {
+	verdicts := map[string]FilterVerdict{
+		"":       filterRedact,
+		"redact": filterRedact,
+		"flag":   filterFlag,
+		"reject": filterReject,
+	}
+	verdict, exists := verdicts[action]
+	if !exists {
+		return nil, errors.New("unknown wordlist action " + action)
+	}
+	words := make(map[string]bool)
+	for _, word := range strings.Split(wordlist, ",") {
+		word = strings.ToLower(strings.TrimSpace(word))
+		if word != "" {
+			words[word] = true
+		}
+	}
+	if len(words) == 0 {
+		return nil, nil
+	}
+	return &WordlistFilter{words: words, verdict: verdict}, nil
+}
+
+// Filter replaces listed words with asterisks
+func (f *WordlistFilter) Filter(user *User, message *Message) FilterResult {
+	found := false
+	var redacted strings.Builder
+	word := []rune{}
+	flush := func() {
+		if f.words[strings.ToLower(string(word))] {
+			found = true
+			redacted.WriteString(strings.Repeat("*", len(word)))
+		} else {
+			redacted.WriteString(string(word))
+		}
+		word = word[:0]
+	}
+	for _, r := range message.Text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			word = append(word, r)
+			continue
+		}
+		flush()
+		redacted.WriteRune(r)
+	}
+	flush()
+	if !found {
+		return FilterResult{Verdict: filterAllow}
+	}
+	return FilterResult{Verdict: f.verdict, Text: redacted.String(), Reason: "message contains blocked words"}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errInvalidInvite   = errors.New("invalid invite")
+	errInviteExpired   = errors.New("invite is expired")
+	errInviteExhausted = errors.New("invite has no uses left")
+)
+
+// Invite lets guests into private or locked rooms
+type Invite struct {
+	ID        string `json:"id"`
+	Room      string `json:"room"`
+	Role      string `json:"role"` // role given to guest, moderator or user
+	ExpiresAt int64  `json:"exp"`
+	MaxUses   int    `json:"max_uses,omitempty"` // unlimited if zero
+	Uses      int    `json:"uses"`
+}
+
+// InviteRequest is a body of invite creation request
+type InviteRequest struct {
+	ExpiresIn int    `json:"expires_in"` // seconds
+	MaxUses   int    `json:"max_uses"`
+	Role      string `json:"role"`
+}
+
+// InviteWrap is a created invite with its token
+type InviteWrap struct {
+	*Invite
+	Token string `json:"token"`
+}
+
+// Invites mints signed invite tokens and tracks their usage
+type Invites struct {
+	secret  []byte
+	invites map[string]*Invite
+	lock    sync.Mutex
+}
+
+// NewInvites creates invites signed with random secret.
+// Like rooms, invites live in memory and do not survive restart
+func NewInvites() *Invites {
+	secret := make([]byte, 32)
+	if _, err := cryptorand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &Invites{
+		secret:  secret,
+		invites: make(map[string]*Invite),
+	}
+}
+
+func (i *Invites) sign(payload string) string {
+	mac := hmac.New(sha256.New, i.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Create mints invite to the room
+func (i *Invites) Create(roomID string, request InviteRequest) (*InviteWrap, error) {
+	if request.ExpiresIn <= 0 {
+		return nil, errors.New("expires_in must be positive")
+	}
+	if request.MaxUses < 0 {
+		return nil, errors.New("max_uses must not be negative")
+	}
+	role := request.Role
+	if role == "" {
+		role = roleUser
+	}
+	if role != roleUser && role != roleModerator {
+		return nil, errors.New("unknown role " + role)
+	}
+	invite := &Invite{
+		ID:        newID(),
+		Room:      roomID,
+		Role:      role,
+		ExpiresAt: time.Now().Add(time.Duration(request.ExpiresIn) * time.Second).Unix(),
+		MaxUses:   request.MaxUses,
+	}
+	payloadRaw, err := json.Marshal(invite)
+	if err != nil {
+		return nil, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(payloadRaw)
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	now := time.Now().Unix()
+	for id, existing := range i.invites {
+		if existing.ExpiresAt <= now {
+			delete(i.invites, id)
+		}
+	}
+	i.invites[invite.ID] = invite
+	created := *invite
+	return &InviteWrap{Invite: &created, Token: payload + "." + i.sign(payload)}, nil
+}
+
+// Verify checks invite token for the room without using it
+func (i *Invites) Verify(token string, roomID string) (*Invite, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(i.sign(parts[0])), []byte(parts[1])) {
+		return nil, errInvalidInvite
+	}
+	payloadRaw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidInvite
+	}
+	var invite Invite
+	if err := json.Unmarshal(payloadRaw, &invite); err != nil {
+		return nil, errInvalidInvite
+	}
+	if invite.Room != roomID {
+		return nil, errInvalidInvite
+	}
+	if time.Now().Unix() >= invite.ExpiresAt {
+		return nil, errInviteExpired
+	}
+	return &invite, nil
+}
+
+// Use counts invite usage. Revoked invites and invites without uses left fail
+func (i *Invites) Use(inviteID string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	invite, exists := i.invites[inviteID]
+	if !exists {
+		return errInvalidInvite
+	}
+	if invite.MaxUses > 0 && invite.Uses >= invite.MaxUses {
+		return errInviteExhausted
+	}
+	invite.Uses++
+	return nil
+}
+
+// Revoke deletes invite of the room
+func (i *Invites) Revoke(roomID string, inviteID string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	invite, exists := i.invites[inviteID]
+	if !exists || invite.Room != roomID {
+		return errNotFound
+	}
+	delete(i.invites, inviteID)
+	return nil
+}
+
+// HandleCreateInvite mints invite to the main room and sends it back with its token.
+// Only moderators can do that, also when auth is not configured
+func (u *User) HandleCreateInvite(request *InviteRequest) error {
+	if !u.IsModerator() {
+		return errForbidden
+	}
+	if request == nil {
+		return errors.New("empty invite request")
+	}
+	room := u.Room()
+	invite, err := room.invites.Create(room.Main().Name, *request)
+	if err != nil {
+		return err
+	}
+	return u.SendEvent(Event{Type: "invite", Invite: invite})
+}
+
+// HandleRevokeInvite revokes invite of the main room. Only moderators can do that
+func (u *User) HandleRevokeInvite(invite *InviteWrap) error {
+	if !u.IsModerator() {
+		return errForbidden
+	}
+	if invite == nil || invite.Invite == nil {
+		return errInvalidInvite
+	}
+	room := u.Room()
+	return room.invites.Revoke(room.Main().Name, invite.ID)
+}
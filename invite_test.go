@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvitesVerify(t *testing.T) {
+	invites := NewInvites()
+	created, err := invites.Create("room", InviteRequest{ExpiresIn: 60, Role: roleModerator})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := NewInvites()
+	foreign, err := other.Create("room", InviteRequest{ExpiresIn: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// payload changed to another room, signed part kept
+	parts := strings.Split(created.Token, ".")
+	forged := *created.Invite
+	forged.Room = "other"
+	forgedRaw, err := json.Marshal(forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgedToken := base64.RawURLEncoding.EncodeToString(forgedRaw) + "." + parts[1]
+
+	// properly signed, but already expired
+	expiredInvite := *created.Invite
+	expiredInvite.ExpiresAt = time.Now().Unix() - 1
+	expiredRaw, err := json.Marshal(expiredInvite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredPayload := base64.RawURLEncoding.EncodeToString(expiredRaw)
+	expiredToken := expiredPayload + "." + invites.sign(expiredPayload)
+
+	tests := []struct {
+		name  string
+		token string
+		room  string
+		err   error
+	}{
+		{"valid", created.Token, "room", nil},
+		{"other room", created.Token, "other", errInvalidInvite},
+		{"forged payload", forgedToken, "other", errInvalidInvite},
+		{"signed by other server", foreign.Token, "room", errInvalidInvite},
+		{"expired", expiredToken, "room", errInviteExpired},
+		{"no signature", parts[0], "room", errInvalidInvite},
+		{"empty", "", "room", errInvalidInvite},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			invite, err := invites.Verify(test.token, test.room)
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if err == nil && (invite.ID != created.ID || invite.Role != roleModerator) {
+				t.Fatalf("got invite %+v", invite)
+			}
+		})
+	}
+}
+
+func TestInvitesUse(t *testing.T) {
+	invites := NewInvites()
+	limited, err := invites.Create("room", InviteRequest{ExpiresIn: 60, MaxUses: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := invites.Use(limited.ID); err != nil {
+			t.Fatalf("use %d: %v", i, err)
+		}
+	}
+	if err := invites.Use(limited.ID); err != errInviteExhausted {
+		t.Fatalf("got error %v, want %v", err, errInviteExhausted)
+	}
+
+	unlimited, err := invites.Create("room", InviteRequest{ExpiresIn: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := invites.Use(unlimited.ID); err != nil {
+			t.Fatalf("use %d: %v", i, err)
+		}
+	}
+
+	if err := invites.Revoke("other", unlimited.ID); err != errNotFound {
+		t.Fatalf("revoked invite of another room: %v", err)
+	}
+	if err := invites.Revoke("room", unlimited.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := invites.Use(unlimited.ID); err != errInvalidInvite {
+		t.Fatalf("got error %v, want %v", err, errInvalidInvite)
+	}
+	if err := invites.Use("unknown"); err != errInvalidInvite {
+		t.Fatalf("got error %v, want %v", err, errInvalidInvite)
+	}
+}
+
+func TestInvitesCreate(t *testing.T) {
+	invites := NewInvites()
+	requests := []InviteRequest{
+		{ExpiresIn: 0},
+		{ExpiresIn: -1},
+		{ExpiresIn: 60, MaxUses: -1},
+		{ExpiresIn: 60, Role: "admin"},
+	}
+	for _, request := range requests {
+		if _, err := invites.Create("room", request); err == nil {
+			t.Errorf("invite created for %+v", request)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+)
+
+var errWaiting = errors.New("waiting for admission")
+
+// EnterLobby puts user to the room waiting list
+// Returns errRoomClosed if the room has been removed meanwhile
+func (r *Room) EnterLobby(user *User) error {
+	r.lobbyLock.Lock()
+	defer r.lobbyLock.Unlock()
+	select {
+	case <-r.closed:
+		return errRoomClosed
+	default:
+	}
+	r.lobby[user.ID] = user
+	return nil
+}
+
+// takeFromLobby removes user from the waiting list
+func (r *Room) takeFromLobby(userID string) (*User, error) {
+	r.lobbyLock.Lock()
+	defer r.lobbyLock.Unlock()
+	user, exists := r.lobby[userID]
+	if !exists {
+		return nil, errNotFound
+	}
+	delete(r.lobby, userID)
+	return user, nil
+}
+
+// LeaveLobby removes user from the waiting list and notifies moderators.
+// Returns false if user was not waiting
+func (r *Room) LeaveLobby(user *User) bool {
+	if _, err := r.takeFromLobby(user.ID); err != nil {
+		return false
+	}
+	r.SendEventModerators(Event{Type: "lobby_leave", User: user.Wrap()})
+	return true
+}
+
+// IsWaiting reports whether user waits for admission
+func (r *Room) IsWaiting(user *User) bool {
+	r.lobbyLock.RLock()
+	defer r.lobbyLock.RUnlock()
+	_, exists := r.lobby[user.ID]
+	return exists
+}
+
+// GetLobbyUsers returns users waiting for admission
+func (r *Room) GetLobbyUsers() []*User {
+	r.lobbyLock.RLock()
+	defer r.lobbyLock.RUnlock()
+	users := []*User{}
+	for _, user := range r.lobby {
+		users = append(users, user)
+	}
+	return users
+}
+
+// GetModerators returns room moderators
+func (r *Room) GetModerators() []*User {
+	users := []*User{}
+	for _, user := range r.GetUsers() {
+		if user.IsModerator() {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// SendEventModerators sends event to every moderator of the room
+func (r *Room) SendEventModerators(event Event) {
+	for _, user := range r.GetModerators() {
+		if err := user.SendEvent(event); err != nil {
+			user.log(err)
+		}
+	}
+}
+
+// Knock tells user to wait and asks moderators to let user in
+func (u *User) Knock() error {
+	if err := u.SendEvent(Event{Type: "waiting"}); err != nil {
+		return err
+	}
+	u.Room().SendEventModerators(Event{Type: "knock", User: u.Wrap()})
+	return nil
+}
+
+// Admit lets waiting user into the room. Only moderators can admit
+func (u *User) Admit(targetID string) error {
+	if !u.IsModerator() {
+		return errForbidden
+	}
+	target, err := u.Room().takeFromLobby(targetID)
+	if err != nil {
+		return err
+	}
+	u.Room().Join(target)
+	return target.SendEventRoom()
+}
+
+// Deny disconnects waiting user with a reason. Only moderators can deny
+func (u *User) Deny(targetID string, reason string) error {
+	if !u.IsModerator() {
+		return errForbidden
+	}
+	target, err := u.Room().takeFromLobby(targetID)
+	if err != nil {
+		return err
+	}
+	if reason == "" {
+		reason = "denied by moderator"
+	}
+	u.Room().SendEventModerators(Event{Type: "lobby_leave", User: target.Wrap()})
+	target.SendEvent(Event{Type: "denied", Desc: reason})
+	target.Disconnect(reason)
+	return nil
+}
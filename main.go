@@ -4,7 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"mime"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -23,11 +27,62 @@ var peerConnectionConfig = webrtc.Configuration{
 }
 
 func main() {
-	rooms := NewRooms()
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		dataDir = dir
+	}
+	chatLog, err := NewChatLog(filepath.Join(dataDir, "chat"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	files, err := NewFiles(filepath.Join(dataDir, "files"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if size := os.Getenv("MAX_FILE_SIZE"); size != "" {
+		if maxFileSize, err = strconv.ParseInt(size, 10, 64); err != nil || maxFileSize <= 0 {
+			log.Fatal("MAX_FILE_SIZE must be positive number of bytes")
+		}
+	}
+	if size := os.Getenv("MAX_ROOM_FILES_SIZE"); size != "" {
+		if maxRoomFilesSize, err = strconv.ParseInt(size, 10, 64); err != nil || maxRoomFilesSize <= 0 {
+			log.Fatal("MAX_ROOM_FILES_SIZE must be positive number of bytes")
+		}
+	}
+	if ttl := os.Getenv("ROOM_TTL"); ttl != "" {
+		if emptyRoomTTL, err = time.ParseDuration(ttl); err != nil {
+			log.Fatal(err)
+		}
+	}
+	rooms := NewRooms(chatLog, files)
+	wordlistFilter, err := ParseWordlistFilter(os.Getenv("CHAT_WORDLIST"), os.Getenv("CHAT_WORDLIST_ACTION"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if wordlistFilter != nil {
+		RegisterContentFilter(wordlistFilter)
+	}
+	auth, err := NewAuthFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	sessionPolicy, err = ParseSessionPolicy(os.Getenv("SESSION_POLICY"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES")); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseActivityTimeouts(os.Getenv("AWAY_TIMEOUT"), os.Getenv("IDLE_TIMEOUT")); err != nil {
+		log.Fatal(err)
+	}
 	router := mux.NewRouter()
 
 	router.HandleFunc("/api/stats", func(w http.ResponseWriter, r *http.Request) {
-		bytes, err := json.Marshal(rooms.GetStats())
+		visible, ok := authorizeRooms(auth, w, r)
+		if !ok {
+			return
+		}
+		bytes, err := json.Marshal(rooms.GetStats(visible))
 		if err != nil {
 			http.Error(w, fmt.Sprint(err), 500)
 		}
@@ -38,6 +93,9 @@ func main() {
 		w.Header().Add("Access-Control-Allow-Origin", "*")
 		vars := mux.Vars(r)
 		roomID := vars["id"]
+		if !authorizeMember(auth, w, r, roomID) {
+			return
+		}
 		room, err := rooms.Get(roomID)
 		if err == errNotFound {
 			http.NotFound(w, r)
@@ -49,12 +107,250 @@ func main() {
 		}
 		w.Write(bytes)
 	}).Methods("GET")
+	router.HandleFunc("/api/rooms/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Access-Control-Allow-Headers", "*")
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		w.Header().Add("Access-Control-Allow-Methods", "GET, PATCH")
+		if r.Method == http.MethodOptions {
+			return
+		}
+		vars := mux.Vars(r)
+		roomID := vars["id"]
+		if !authorizeModerator(auth, w, r, roomID) {
+			return
+		}
+		room, err := rooms.Get(roomID)
+		if err == errNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		var update RoomUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, fmt.Sprint(err), 400)
+			return
+		}
+		if err := room.Update(update); err != nil {
+			http.Error(w, fmt.Sprint(err), 400)
+			return
+		}
+		bytes, err := json.Marshal(room.Wrap(nil))
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), 500)
+		}
+		w.Write(bytes)
+	}).Methods("PATCH", "OPTIONS")
+
+	router.HandleFunc("/api/rooms/{id}/messages", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Access-Control-Allow-Headers", "*")
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		roomID := mux.Vars(r)["id"]
+		if !authorizeMember(auth, w, r, roomID) {
+			return
+		}
+		query := r.URL.Query()
+		limit := defaultChatPageSize
+		if value := query.Get("limit"); value != "" {
+			if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+				http.Error(w, "limit must be positive", 400)
+				return
+			}
+		}
+		if limit > maxChatPageSize {
+			limit = maxChatPageSize
+		}
+		messages, err := rooms.chatLog.Read(roomID, query.Get("before"), limit)
+		if err == errMessageNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), 500)
+			return
+		}
+		bytes, err := json.Marshal(messages)
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), 500)
+		}
+		w.Write(bytes)
+	}).Methods("GET")
+	router.HandleFunc("/api/rooms/{id}/files", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Access-Control-Allow-Headers", "*")
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		w.Header().Add("Access-Control-Allow-Methods", "POST")
+		if r.Method == http.MethodOptions {
+			return
+		}
+		roomID := mux.Vars(r)["id"]
+		room, err := rooms.Get(roomID)
+		if err == errNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		user, err := room.FindMember(r.URL.Query().Get("secret"))
+		if err != nil || !user.CanChat() {
+			http.Error(w, fmt.Sprint(errForbidden), 403)
+			return
+		}
+		if !user.chatLimiter.Allow() {
+			http.Error(w, fmt.Sprint(errRateLimited), 429)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxFileSize+1<<20)
+		upload, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), 400)
+			return
+		}
+		defer upload.Close()
+		file, err := rooms.files.Save(roomID, user, header.Filename, upload)
+		if err == errFileTooLarge || err == errRoomQuota {
+			http.Error(w, fmt.Sprint(err), 413)
+			return
+		}
+		if err == errFileType {
+			http.Error(w, fmt.Sprint(err), 415)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), 500)
+			return
+		}
+		if err := user.ShareFile(file); err != nil {
+			user.log(err)
+		}
+		bytes, err := json.Marshal(file)
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), 500)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write(bytes)
+	}).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/rooms/{id}/files/{file_id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Access-Control-Allow-Headers", "*")
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		vars := mux.Vars(r)
+		room, err := rooms.Get(vars["id"])
+		if err == errNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if _, err := room.FindMember(r.URL.Query().Get("secret")); err != nil {
+			http.Error(w, fmt.Sprint(errForbidden), 403)
+			return
+		}
+		file, path, err := rooms.files.Get(vars["id"], vars["file_id"])
+		if err == errNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		content, err := os.Open(path)
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), 500)
+			return
+		}
+		defer content.Close()
+		disposition := "attachment"
+		if strings.HasPrefix(file.Type, "image/") {
+			disposition = "inline"
+		}
+		w.Header().Set("Content-Type", file.Type)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": file.Name}))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeContent(w, r, "", time.Unix(0, file.Time*int64(time.Millisecond)), content)
+	}).Methods("GET")
+	router.HandleFunc("/api/rooms/{id}/invites", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Access-Control-Allow-Headers", "*")
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		w.Header().Add("Access-Control-Allow-Methods", "POST")
+		if r.Method == http.MethodOptions {
+			return
+		}
+		roomID := mux.Vars(r)["id"]
+		if !authorizeModerator(auth, w, r, roomID) {
+			return
+		}
+		var request InviteRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprint(err), 400)
+			return
+		}
+		invite, err := rooms.invites.Create(roomID, request)
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), 400)
+			return
+		}
+		bytes, err := json.Marshal(invite)
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), 500)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write(bytes)
+	}).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/rooms/{id}/invites/{invite_id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Access-Control-Allow-Headers", "*")
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		w.Header().Add("Access-Control-Allow-Methods", "DELETE")
+		if r.Method == http.MethodOptions {
+			return
+		}
+		vars := mux.Vars(r)
+		if !authorizeModerator(auth, w, r, vars["id"]) {
+			return
+		}
+		if err := rooms.invites.Revoke(vars["id"], vars["invite_id"]); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE", "OPTIONS")
+
+	router.HandleFunc("/api/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Access-Control-Allow-Headers", "*")
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		visible, ok := authorizeRooms(auth, w, r)
+		if !ok {
+			return
+		}
+		presence, err := rooms.presence.Get(mux.Vars(r)["id"], visible)
+		if err == errNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		bytes, err := json.Marshal(presence)
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), 500)
+		}
+		w.Write(bytes)
+	}).Methods("GET")
+	router.HandleFunc("/api/presence/{identity}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Access-Control-Allow-Headers", "*")
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		visible, ok := authorizeRooms(auth, w, r)
+		if !ok {
+			return
+		}
+		presence, err := rooms.presence.GetByIdentity(mux.Vars(r)["identity"], visible)
+		if err == errNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		bytes, err := json.Marshal(presence)
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), 500)
+		}
+		w.Write(bytes)
+	}).Methods("GET")
+
+	router.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		rooms.WriteMetrics(w)
+	}).Methods("GET")
 
 	router.HandleFunc("/{id}", func(w http.ResponseWriter, r *http.Request) {
-		serveWs(rooms, w, r)
+		serveWs(rooms, auth, w, r)
 	})
 
-	// go rooms.Watch()
+	go rooms.Watch()
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "80"
@@ -72,3 +368,54 @@ func main() {
 
 	log.Fatal(srv.ListenAndServe())
 }
+
+// authorizeMember checks that request has token allowing to join the room.
+// Everyone is allowed when auth is not configured
+func authorizeMember(auth *Auth, w http.ResponseWriter, r *http.Request, roomID string) bool {
+	if auth == nil {
+		return true
+	}
+	claims, err := auth.Authenticate(r)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 401)
+		return false
+	}
+	if !claims.CanJoin(roomID) {
+		http.Error(w, fmt.Sprint(errForbidden), 403)
+		return false
+	}
+	return true
+}
+
+// authorizeRooms checks that request has a valid token and returns
+// which rooms it is allowed to see. All rooms are visible when auth is not configured
+func authorizeRooms(auth *Auth, w http.ResponseWriter, r *http.Request) (func(roomID string) bool, bool) {
+	if auth == nil {
+		return func(roomID string) bool { return true }, true
+	}
+	claims, err := auth.Authenticate(r)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 401)
+		return nil, false
+	}
+	return claims.CanJoin, true
+}
+
+// authorizeModerator checks that request has moderator token for the room.
+// Nobody is allowed when auth is not configured, as moderators can not be told apart
+func authorizeModerator(auth *Auth, w http.ResponseWriter, r *http.Request, roomID string) bool {
+	if auth == nil {
+		http.Error(w, fmt.Sprint(errAuthRequired), 403)
+		return false
+	}
+	claims, err := auth.Authenticate(r)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 401)
+		return false
+	}
+	if claims.Role != roleModerator || !claims.CanJoin(roomID) {
+		http.Error(w, fmt.Sprint(errForbidden), 403)
+		return false
+	}
+	return true
+}
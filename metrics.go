@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Labels kept per labeled counter, the rest are counted as "other".
+const maxMetricLabels = 100
+
+// labeledCounter counts events by label, e.g. by event type
+type labeledCounter struct {
+	values map[string]uint64
+	lock   sync.Mutex
+}
+
+func newLabeledCounter() *labeledCounter {
+	return &labeledCounter{values: make(map[string]uint64)}
+}
+
+// Inc increments counter of the label
+func (c *labeledCounter) Inc(label string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, exists := c.values[label]; !exists && len(c.values) >= maxMetricLabels {
+		label = "other"
+	}
+	c.values[label]++
+}
+
+// Values returns copy of counters by label
+func (c *labeledCounter) Values() map[string]uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	values := make(map[string]uint64, len(c.values))
+	for label, value := range c.values {
+		values[label] = value
+	}
+	return values
+}
+
+// metrics are server counters exposed on /metrics, counters are updated atomically
+var metrics = struct {
+	rtpPacketsReceived  uint64
+	rtpBytesReceived    uint64
+	rtpPacketsForwarded uint64
+	rtpBytesForwarded   uint64
+	rtpWriteErrors      uint64
+	invalidTrack        uint64
+	sendQueueEvictions  uint64
+	renegotiations      uint64
+	events              *labeledCounter // websocket events by type
+	iceStates           *labeledCounter // ice connection state transitions by new state
+}{
+	events:    newLabeledCounter(),
+	iceStates: newLabeledCounter(),
+}
+
+// WriteMetrics writes metrics in prometheus text format
+func (r *Rooms) WriteMetrics(w io.Writer) {
+	var rooms, users, published, subscribed int
+	for _, room := range r.List() {
+		for _, roomOrBreakout := range append([]*Room{room}, room.GetBreakouts()...) {
+			rooms++
+			for _, user := range roomOrBreakout.GetUsers() {
+				users++
+				user.inTracksLock.RLock()
+				published += len(user.inTracks)
+				user.inTracksLock.RUnlock()
+				user.outTracksLock.RLock()
+				subscribed += len(user.outTracks)
+				user.outTracksLock.RUnlock()
+			}
+		}
+	}
+
+	writeMetric(w, "voicechat_rooms", "gauge", "Open rooms, including breakout rooms.", rooms)
+	writeMetric(w, "voicechat_users", "gauge", "Users joined to rooms.", users)
+	writeMetric(w, "voicechat_published_tracks", "gauge", "Tracks received from users.", published)
+	writeMetric(w, "voicechat_subscribed_tracks", "gauge", "Tracks sent to users.", subscribed)
+	writeMetric(w, "voicechat_rtp_packets_received_total", "counter", "RTP packets received from users.", atomic.LoadUint64(&metrics.rtpPacketsReceived))
+	writeMetric(w, "voicechat_rtp_bytes_received_total", "counter", "RTP bytes received from users.", atomic.LoadUint64(&metrics.rtpBytesReceived))
+	writeMetric(w, "voicechat_rtp_packets_forwarded_total", "counter", "RTP packets forwarded to users.", atomic.LoadUint64(&metrics.rtpPacketsForwarded))
+	writeMetric(w, "voicechat_rtp_bytes_forwarded_total", "counter", "RTP bytes forwarded to users.", atomic.LoadUint64(&metrics.rtpBytesForwarded))
+	writeMetric(w, "voicechat_rtp_write_errors_total", "counter", "Errors writing RTP to user tracks.", atomic.LoadUint64(&metrics.rtpWriteErrors))
+	writeMetric(w, "voicechat_invalid_track_total", "counter", "RTP packets for tracks user does not have.", atomic.LoadUint64(&metrics.invalidTrack))
+	writeMetric(w, "voicechat_send_queue_evictions_total", "counter", "Messages dropped from send queues of slow clients.", atomic.LoadUint64(&metrics.sendQueueEvictions))
+	writeMetric(w, "voicechat_renegotiations_total", "counter", "Offers sent by server to renegotiate.", atomic.LoadUint64(&metrics.renegotiations))
+	writeLabeledMetric(w, "voicechat_websocket_events_total", "Websocket events received by type.", "type", metrics.events)
+	writeLabeledMetric(w, "voicechat_ice_state_transitions_total", "ICE connection state changes by new state.", "state", metrics.iceStates)
+}
+
+func writeMetric(w io.Writer, name string, metricType string, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, metricType, name, value)
+}
+
+func writeLabeledMetric(w io.Writer, name string, help string, label string, counter *labeledCounter) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	values := counter.Values()
+	labels := []string{}
+	for value := range values {
+		labels = append(labels, value)
+	}
+	sort.Strings(labels)
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for _, value := range labels {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, escaper.Replace(value), values[value])
+	}
+}
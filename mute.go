@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+)
+
+var errMutedByModerator = errors.New("muted by moderator")
+
+// IsMuted reports whether user microphone audio is dropped by the server
+func (u *User) IsMuted() bool {
+	u.infoLock.RLock()
+	defer u.infoLock.RUnlock()
+	return u.info.Mute
+}
+
+// HandleMute mutes user microphone. Moderators can mute target user,
+// then only a moderator can let the user unmute again
+func (u *User) HandleMute(targetID string) error {
+	if targetID == "" || targetID == u.ID {
+		u.infoLock.Lock()
+		u.info.Mute = true
+		u.infoLock.Unlock()
+		return u.BroadcastEventMute()
+	}
+	if !u.IsModerator() {
+		return errForbidden
+	}
+	target, err := u.Room().GetUser(targetID)
+	if err != nil {
+		return err
+	}
+	target.infoLock.Lock()
+	target.info.Mute = true
+	target.info.MuteLocked = true
+	target.infoLock.Unlock()
+	return u.Room().BroadcastEvent(Event{Type: "mute", User: target.Wrap()}, nil)
+}
+
+// HandleUnmute unmutes user microphone. Moderators can not unmute target user,
+// they only allow the user to unmute after moderator mute
+func (u *User) HandleUnmute(targetID string) error {
+	if targetID == "" || targetID == u.ID {
+		u.infoLock.Lock()
+		if u.info.MuteLocked {
+			u.infoLock.Unlock()
+			return errMutedByModerator
+		}
+		if !u.info.Permissions.Publish {
+			u.infoLock.Unlock()
+			return errPublishNotAllowed
+		}
+		u.info.Mute = false
+		u.infoLock.Unlock()
+		return u.BroadcastEventUnmute()
+	}
+	if !u.IsModerator() {
+		return errForbidden
+	}
+	target, err := u.Room().GetUser(targetID)
+	if err != nil {
+		return err
+	}
+	target.infoLock.Lock()
+	target.info.MuteLocked = false
+	target.infoLock.Unlock()
+	return target.BroadcastEventUpdate()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/pion/webrtc/v2"
+)
+
+var errPublishNotAllowed = errors.New("publishing is not allowed")
+
+// Permissions are user capabilities enforced by the server
+type Permissions struct {
+	Publish    bool `json:"publish"`     // send microphone audio
+	Subscribe  bool `json:"subscribe"`   // receive audio of the room
+	Chat       bool `json:"chat"`        // send messages and signals to the room
+	ChangeRoom bool `json:"change_room"` // change room title, topic, metadata and lock it
+}
+
+// allPermissions are given to moderators
+var allPermissions = Permissions{
+	Publish:    true,
+	Subscribe:  true,
+	Chat:       true,
+	ChangeRoom: true,
+}
+
+// ParsePermissions reads list of permission names, e.g. `publish,subscribe,chat`
+func ParsePermissions(names []string) Permissions {
+	permissions := Permissions{}
+	for _, name := range names {
+		switch strings.TrimSpace(name) {
+		case "publish":
+			permissions.Publish = true
+		case "subscribe":
+			permissions.Subscribe = true
+		case "chat":
+			permissions.Chat = true
+		case "change_room":
+			permissions.ChangeRoom = true
+		}
+	}
+	return permissions
+}
+
+// GetPermissions returns user permissions
+func (u *User) GetPermissions() Permissions {
+	u.infoLock.RLock()
+	defer u.infoLock.RUnlock()
+	return u.info.Permissions
+}
+
+// CanPublish reports whether user is allowed to publish audio
+func (u *User) CanPublish() bool {
+	return u.GetPermissions().Publish
+}
+
+// CanSubscribe reports whether user is allowed to receive audio of the room
+func (u *User) CanSubscribe() bool {
+	return u.GetPermissions().Subscribe
+}
+
+// CanChat reports whether user is allowed to send messages to the room
+func (u *User) CanChat() bool {
+	return u.GetPermissions().Chat
+}
+
+// CanChangeRoom reports whether user is allowed to change the room
+func (u *User) CanChangeRoom() bool {
+	return u.GetPermissions().ChangeRoom
+}
+
+// SetPermissions changes user permissions and renegotiates media when
+// publish or subscribe rights change
+func (u *User) SetPermissions(permissions Permissions) error {
+	u.infoLock.Lock()
+	old := u.info.Permissions
+	u.info.Permissions = permissions
+	if permissions.Publish {
+		u.info.Hand = false
+	} else {
+		u.info.Mute = true
+	}
+	u.infoLock.Unlock()
+
+	if old.Subscribe != permissions.Subscribe {
+		if permissions.Subscribe {
+			if err := u.attachRoomTracks(); err != nil {
+				return err
+			}
+		} else {
+			u.detachRoomTracks()
+			if err := u.SendOffer(); err != nil {
+				return err
+			}
+		}
+	}
+	if old.Publish != permissions.Publish {
+		if permissions.Publish {
+			return u.grantPublish()
+		}
+		u.unpublishTracks(u.GetInTrackSSRCs())
+	}
+	return nil
+}
+
+// grantPublish attaches user microphone to the room, or asks for it
+// if user has never published before
+func (u *User) grantPublish() error {
+	ssrcs := u.GetInTrackSSRCs()
+	if len(ssrcs) > 0 {
+		u.publishTracks(ssrcs)
+		return nil
+	}
+	_, err := u.pc.AddTransceiver(webrtc.RTPCodecTypeAudio, webrtc.RtpTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	})
+	if err != nil {
+		return err
+	}
+	return u.SendOffer()
+}
+
+// HandleSetPermissions changes permissions of target user. Only moderators can do that
+func (u *User) HandleSetPermissions(targetID string, permissions *Permissions) error {
+	if !u.IsModerator() {
+		return errForbidden
+	}
+	if permissions == nil {
+		return errors.New("empty permissions")
+	}
+	target, err := u.Room().FindUser(targetID)
+	if err != nil {
+		return err
+	}
+	if err := target.SetPermissions(*permissions); err != nil {
+		return err
+	}
+	return target.BroadcastEventUpdate()
+}
+
+// offerPublishesAudio reports whether any audio section of sdp is
+// sendrecv or sendonly. Sections without direction attribute are sendrecv
+func offerPublishesAudio(offer webrtc.SessionDescription) bool {
+	audio := false
+	publishes := false
+	for _, line := range strings.Split(offer.SDP, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "m=") {
+			if audio && publishes {
+				return true
+			}
+			fields := strings.Fields(line)
+			// rejected sections have zero port
+			audio = strings.HasPrefix(line, "m=audio") && len(fields) > 1 && fields[1] != "0"
+			publishes = true
+			continue
+		}
+		if line == "a=recvonly" || line == "a=inactive" {
+			publishes = false
+		}
+	}
+	return audio && publishes
+}
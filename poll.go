@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Open polls allowed per room.
+	maxOpenPolls = 10
+	// Maximum poll question length in characters.
+	maxPollQuestionLength = 300
+	// Maximum poll option length in characters.
+	maxPollOptionLength = 100
+	// Maximum options per poll.
+	maxPollOptions = 10
+
+	pollCreatorsEveryone   = "everyone"
+	pollCreatorsModerators = "moderators"
+)
+
+var (
+	errPollNotFound = errors.New("poll_not_found")
+	errAlreadyVoted = errors.New("already_voted")
+)
+
+// Poll is a question with options users vote for
+type Poll struct {
+	ID       string    `json:"id"`
+	Question string    `json:"question"`
+	Options  []string  `json:"options"`
+	Votes    []int     `json:"votes"`          // votes per option, set by server
+	User     *UserWrap `json:"user,omitempty"` // author, set by server
+	Closed   bool      `json:"closed,omitempty"`
+
+	voters map[string]int // voter key to option index
+}
+
+// Vote is a vote for an option of a poll
+type Vote struct {
+	Poll   string `json:"poll"`
+	Option int    `json:"option"` // index of the option
+}
+
+// wrap copies poll for sending, must be called with pollsLock held
+func (p *Poll) wrap() *Poll {
+	votes := make([]int, len(p.Votes))
+	copy(votes, p.Votes)
+	return &Poll{
+		ID:       p.ID,
+		Question: p.Question,
+		Options:  p.Options,
+		Votes:    votes,
+		User:     p.User,
+		Closed:   p.Closed,
+	}
+}
+
+// GetPolls returns open polls of the room
+func (r *Room) GetPolls() []*Poll {
+	r.pollsLock.Lock()
+	defer r.pollsLock.Unlock()
+	polls := []*Poll{}
+	for _, poll := range r.polls {
+		polls = append(polls, poll.wrap())
+	}
+	return polls
+}
+
+// findPoll returns index of open poll, must be called with pollsLock held
+func (r *Room) findPoll(pollID string) (int, error) {
+	for i, poll := range r.polls {
+		if poll.ID == pollID {
+			return i, nil
+		}
+	}
+	return 0, errPollNotFound
+}
+
+// canCreatePoll checks room poll creators setting
+func (u *User) canCreatePoll() bool {
+	r := u.Room()
+	r.pollsLock.Lock()
+	defer r.pollsLock.Unlock()
+	return u.CanChat() && (r.pollCreators != pollCreatorsModerators || u.IsModerator())
+}
+
+// CreatePoll opens new poll in the room and broadcasts poll_update
+func (u *User) CreatePoll(poll *Poll) error {
+	if !u.canCreatePoll() {
+		return errForbidden
+	}
+	if !u.chatLimiter.Allow() {
+		return errRateLimited
+	}
+	if poll == nil {
+		return errors.New("empty poll")
+	}
+	question := strings.TrimSpace(poll.Question)
+	if question == "" || utf8.RuneCountInString(question) > maxPollQuestionLength {
+		return fmt.Errorf("question must be 1 to %d characters", maxPollQuestionLength)
+	}
+	if len(poll.Options) < 2 || len(poll.Options) > maxPollOptions {
+		return fmt.Errorf("poll must have 2 to %d options", maxPollOptions)
+	}
+	options := []string{}
+	for _, option := range poll.Options {
+		option = strings.TrimSpace(option)
+		if option == "" || utf8.RuneCountInString(option) > maxPollOptionLength {
+			return fmt.Errorf("option must be 1 to %d characters", maxPollOptionLength)
+		}
+		options = append(options, option)
+	}
+	created := &Poll{
+		ID:       newID(),
+		Question: question,
+		Options:  options,
+		Votes:    make([]int, len(options)),
+		User:     u.Wrap(),
+		voters:   make(map[string]int),
+	}
+
+	r := u.Room()
+	r.pollsLock.Lock()
+	if len(r.polls) >= maxOpenPolls {
+		r.pollsLock.Unlock()
+		return fmt.Errorf("room already has %d open polls", maxOpenPolls)
+	}
+	r.polls = append(r.polls, created)
+	update := created.wrap()
+	r.pollsLock.Unlock()
+	return r.BroadcastEvent(Event{Type: "poll_update", Poll: update}, nil)
+}
+
+// voter identifies who votes, so that reconnecting does not give another vote.
+// Anonymous users have only their session id
+func (u *User) voter() string {
+	if u.identity != "" {
+		return "identity:" + u.identity
+	}
+	return "session:" + u.ID
+}
+
+// HandleVote counts user vote, every identity votes once
+func (u *User) HandleVote(vote *Vote) error {
+	if vote == nil {
+		return errPollNotFound
+	}
+	r := u.Room()
+	r.pollsLock.Lock()
+	i, err := r.findPoll(vote.Poll)
+	if err != nil {
+		r.pollsLock.Unlock()
+		return err
+	}
+	poll := r.polls[i]
+	if vote.Option < 0 || vote.Option >= len(poll.Options) {
+		r.pollsLock.Unlock()
+		return errors.New("unknown option")
+	}
+	voter := u.voter()
+	if _, voted := poll.voters[voter]; voted {
+		r.pollsLock.Unlock()
+		return errAlreadyVoted
+	}
+	poll.voters[voter] = vote.Option
+	poll.Votes[vote.Option]++
+	update := poll.wrap()
+	r.pollsLock.Unlock()
+	return r.BroadcastEvent(Event{Type: "poll_update", Poll: update}, nil)
+}
+
+// ClosePoll stops voting and broadcasts final results.
+// Authors can close their own polls, moderators any poll
+func (u *User) ClosePoll(pollID string) error {
+	r := u.Room()
+	r.pollsLock.Lock()
+	i, err := r.findPoll(pollID)
+	if err != nil {
+		r.pollsLock.Unlock()
+		return err
+	}
+	poll := r.polls[i]
+	if !u.IsModerator() && !u.isAuthor(poll.User) {
+		r.pollsLock.Unlock()
+		return errForbidden
+	}
+	poll.Closed = true
+	r.polls = append(r.polls[:i:i], r.polls[i+1:]...)
+	update := poll.wrap()
+	r.pollsLock.Unlock()
+	return r.BroadcastEvent(Event{Type: "poll_update", Poll: update}, nil)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+)
+
+type presenceEntry struct {
+	user *User
+	room *Room
+}
+
+// Presence is a global index of users joined to rooms,
+// kept up to date by room join and leave
+type Presence struct {
+	users      map[string]presenceEntry            // by user id
+	identities map[string]map[string]presenceEntry // by identity, then user id
+	lock       sync.RWMutex
+}
+
+// PresenceWrap is a public representation of where user is
+type PresenceWrap struct {
+	Room string    `json:"room"`
+	User *UserWrap `json:"user"`
+}
+
+// NewPresence creates presence index
+func NewPresence() *Presence {
+	return &Presence{
+		users:      make(map[string]presenceEntry),
+		identities: make(map[string]map[string]presenceEntry),
+	}
+}
+
+// Add puts user to the index
+func (p *Presence) Add(user *User, room *Room) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	entry := presenceEntry{user: user, room: room}
+	p.users[user.ID] = entry
+	if user.identity == "" {
+		return
+	}
+	if p.identities[user.identity] == nil {
+		p.identities[user.identity] = make(map[string]presenceEntry)
+	}
+	p.identities[user.identity][user.ID] = entry
+}
+
+// Remove deletes user from the index unless user has already joined another room
+func (p *Presence) Remove(user *User, room *Room) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if entry, exists := p.users[user.ID]; !exists || entry.room != room {
+		return
+	}
+	delete(p.users, user.ID)
+	if sessions, exists := p.identities[user.identity]; exists {
+		delete(sessions, user.ID)
+		if len(sessions) == 0 {
+			delete(p.identities, user.identity)
+		}
+	}
+}
+
+// Get returns where user with id is, if the room is visible to caller
+func (p *Presence) Get(userID string, visible func(roomID string) bool) (*PresenceWrap, error) {
+	p.lock.RLock()
+	entry, exists := p.users[userID]
+	p.lock.RUnlock()
+	if !exists || !visible(entry.room.Main().Name) {
+		return nil, errNotFound
+	}
+	return &PresenceWrap{Room: entry.room.Name, User: entry.user.Wrap()}, nil
+}
+
+// GetByIdentity returns where every session of identity is, in rooms visible to caller
+func (p *Presence) GetByIdentity(identity string, visible func(roomID string) bool) ([]*PresenceWrap, error) {
+	p.lock.RLock()
+	entries := []presenceEntry{}
+	for _, entry := range p.identities[identity] {
+		if visible(entry.room.Main().Name) {
+			entries = append(entries, entry)
+		}
+	}
+	p.lock.RUnlock()
+	if len(entries) == 0 {
+		return nil, errNotFound
+	}
+	presence := []*PresenceWrap{}
+	for _, entry := range entries {
+		presence = append(presence, &PresenceWrap{Room: entry.room.Name, User: entry.user.Wrap()})
+	}
+	return presence, nil
+}
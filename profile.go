@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxNameLength           = 50
+	maxAvatarLength         = 2048
+	maxAttributes           = 20
+	maxAttributeKeyLength   = 50
+	maxAttributeValueLength = 500
+)
+
+// Profile is a user editable part of UserInfo, omitted fields are kept as is
+type Profile struct {
+	Name       *string           `json:"name,omitempty"`
+	Avatar     *string           `json:"avatar,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"` // replaces all attributes
+}
+
+var errNameLocked = errors.New("name is set by token")
+
+// ProfileFromQuery reads profile set at connect time,
+// e.g. `/myroom?name=Bob&avatar=https://...&attributes={"team":"red"}`
+func ProfileFromQuery(query url.Values) (Profile, error) {
+	profile := Profile{}
+	if _, ok := query["name"]; ok {
+		name := query.Get("name")
+		profile.Name = &name
+	}
+	if _, ok := query["avatar"]; ok {
+		avatar := query.Get("avatar")
+		profile.Avatar = &avatar
+	}
+	if attributes := query.Get("attributes"); attributes != "" {
+		if err := json.Unmarshal([]byte(attributes), &profile.Attributes); err != nil {
+			return profile, errors.New("attributes must be json object of strings")
+		}
+	}
+	return profile, nil
+}
+
+// Validate checks profile limits. Name is trimmed
+func (p *Profile) Validate() error {
+	if p.Name != nil {
+		name := strings.TrimSpace(*p.Name)
+		if utf8.RuneCountInString(name) > maxNameLength {
+			return fmt.Errorf("name is longer than %d characters", maxNameLength)
+		}
+		p.Name = &name
+	}
+	if p.Avatar != nil && *p.Avatar != "" {
+		if len(*p.Avatar) > maxAvatarLength {
+			return fmt.Errorf("avatar is longer than %d characters", maxAvatarLength)
+		}
+		avatar, err := url.Parse(*p.Avatar)
+		if err != nil || (avatar.Scheme != "http" && avatar.Scheme != "https") || avatar.Host == "" {
+			return errors.New("avatar must be http(s) url")
+		}
+	}
+	if len(p.Attributes) > maxAttributes {
+		return fmt.Errorf("more than %d attributes", maxAttributes)
+	}
+	for key, value := range p.Attributes {
+		if key == "" || utf8.RuneCountInString(key) > maxAttributeKeyLength {
+			return fmt.Errorf("attribute key must be 1 to %d characters", maxAttributeKeyLength)
+		}
+		if utf8.RuneCountInString(value) > maxAttributeValueLength {
+			return fmt.Errorf("attribute %s is longer than %d characters", key, maxAttributeValueLength)
+		}
+	}
+	return nil
+}
+
+// ApplyProfile updates user info with validated profile
+func (u *User) ApplyProfile(profile Profile) {
+	u.infoLock.Lock()
+	defer u.infoLock.Unlock()
+	if profile.Name != nil {
+		u.info.Name = *profile.Name
+	}
+	if profile.Avatar != nil {
+		u.info.Avatar = *profile.Avatar
+	}
+	if profile.Attributes != nil {
+		u.info.Attributes = profile.Attributes
+	}
+}
+
+// UpdateProfile validates and applies profile, then broadcasts user_update to the room.
+// Name given by token claims can not be changed
+func (u *User) UpdateProfile(profile *Profile) error {
+	if profile == nil {
+		return errors.New("empty profile")
+	}
+	if profile.Name != nil && u.nameLocked {
+		return errNameLocked
+	}
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+	u.ApplyProfile(*profile)
+	return u.BroadcastEventUpdate()
+}
+
+// BroadcastEventUpdate sends user_update event to everyone in the room
+func (u *User) BroadcastEventUpdate() error {
+	return u.Room().BroadcastEvent(Event{Type: "user_update", User: u.Wrap()}, nil)
+}
@@ -1,22 +1,108 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
+const (
+	// How often empty rooms are looked for.
+	roomsCheckPeriod = time.Minute
+)
+
+// Room empty for emptyRoomTTL is removed with its files, `ROOM_TTL` env.
+var emptyRoomTTL = 10 * time.Minute
+
 type broadcastMsg struct {
-	data []byte
-	user *User // message will be broadcasted to everyone, except this user
+	data     []byte
+	user     *User // message will be broadcasted to everyone, except this user
+	priority int   // priority in users send queues
+}
+
+type kickMsg struct {
+	user   *User
+	reason string // sent to user in websocket close frame
 }
 
 // Room maintains the set of active clients and broadcasts messages to the
 // clients.
 type Room struct {
 	Name      string
+	options   RoomOptions
+	title     string
+	topic     string
+	metadata  json.RawMessage // arbitrary json set by moderators
+	locked    bool            // no new users can join
+	bans      []Ban
+	infoLock  sync.RWMutex
 	users     map[string]*User
+	usersLock sync.RWMutex     // users are changed only by run
+	lobby     map[string]*User // users waiting for admission
+	lobbyLock sync.RWMutex
 	broadcast chan broadcastMsg
 	join      chan *User // Register requests from the clients.
 	leave     chan *User // Unregister requests from clients.
+	detach    chan *User // Moves client out of the room keeping connection open.
+	kick      chan kickMsg
+	closed    chan struct{} // stops the room after it is removed
+	closeOnce sync.Once
+	gc        chan chan bool // asks run to close the room if it is empty
+	presence  *Presence      // global index of joined users, shared by all rooms
+	invites   *Invites       // shared by all rooms
+
+	chat        []*Message // recent chat messages, at most maxChatHistory
+	chatLock    sync.RWMutex
+	chatLog     *ChatLog  // persistent chat, shared by all rooms
+	historyOnce sync.Once // loads chat history from the log
+
+	polls        []*Poll // open polls
+	pollCreators string  // who can create polls, everyone or moderators
+	pollsLock    sync.Mutex
+
+	state        map[string]*StateEntry // shared key-value state of clients
+	stateVersion int64                  // incremented on every state change
+	stateLock    sync.Mutex
+
+	parent        *Room            // main room if this is a breakout room
+	breakouts     map[string]*Room // breakout rooms by name
+	breakoutTimer *time.Timer
+	breakoutsLock sync.Mutex
+}
+
+// RoomOptions configures room behaviour. Options are taken from the query
+// string of the first connection, e.g. `/myroom?mode=stage`
+type RoomOptions struct {
+	Stage bool // only speakers can publish audio, everyone else listens
+	Lobby bool // new users wait until moderator admits them
+
+	Permissions Permissions // given to new users, `?permissions=publish,subscribe,chat`
+}
+
+// ParseRoomOptions reads room options from url query
+func ParseRoomOptions(query url.Values) RoomOptions {
+	lobby, _ := strconv.ParseBool(query.Get("lobby"))
+	options := RoomOptions{
+		Stage: query.Get("mode") == "stage",
+		Lobby: lobby,
+		Permissions: Permissions{
+			Subscribe: true,
+			Chat:      true,
+		},
+	}
+	// in stage rooms everyone starts in the audience
+	options.Permissions.Publish = !options.Stage
+	if _, ok := query["permissions"]; ok {
+		options.Permissions = ParsePermissions(strings.Split(query.Get("permissions"), ","))
+	}
+	return options
 }
 
 // RoomWrap is a public representation of a room
@@ -24,6 +110,20 @@ type RoomWrap struct {
 	Users  []*UserWrap `json:"users"`
 	Name   string      `json:"name"`
 	Online int         `json:"online"`
+	Stage  bool        `json:"stage"`
+	Title  string      `json:"title"`
+	Topic  string      `json:"topic"`
+	Locked bool        `json:"locked"`
+
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+
+	Lobby []*UserWrap `json:"lobby,omitempty"` // waiting users, visible to moderators only
+
+	Breakouts []*RoomWrap `json:"breakouts,omitempty"`
+	Messages  []*Message  `json:"messages,omitempty"` // recent chat, sent to room members only
+	Polls     []*Poll     `json:"polls,omitempty"`    // open polls, sent to room members only
+
+	PollCreators string `json:"poll_creators"`
 }
 
 // Wrap returns public version of room
@@ -39,26 +139,128 @@ func (r *Room) Wrap(me *User) *RoomWrap {
 		usersWrap = append(usersWrap, user.Wrap())
 	}
 
+	var lobbyWrap []*UserWrap
+	if me != nil && me.IsModerator() {
+		for _, user := range r.GetLobbyUsers() {
+			lobbyWrap = append(lobbyWrap, user.Wrap())
+		}
+	}
+
+	var breakoutsWrap []*RoomWrap
+	for _, breakout := range r.GetBreakouts() {
+		breakoutsWrap = append(breakoutsWrap, breakout.Wrap(nil))
+	}
+
+	var messages []*Message
+	var polls []*Poll
+	if me != nil {
+		messages = r.GetChatHistory()
+		polls = r.GetPolls()
+	}
+	r.pollsLock.Lock()
+	pollCreators := r.pollCreators
+	r.pollsLock.Unlock()
+
+	r.infoLock.RLock()
+	defer r.infoLock.RUnlock()
 	return &RoomWrap{
-		Users:  usersWrap,
-		Name:   r.Name,
-		Online: len(usersWrap),
+		Users:     usersWrap,
+		Name:      r.Name,
+		Online:    len(usersWrap),
+		Stage:     r.options.Stage,
+		Title:     r.title,
+		Topic:     r.topic,
+		Locked:    r.locked,
+		Metadata:  r.metadata,
+		Lobby:     lobbyWrap,
+		Breakouts: breakoutsWrap,
+		Messages:  messages,
+		Polls:     polls,
+
+		PollCreators: pollCreators,
+	}
+}
+
+// RoomUpdate changes room description, omitted fields are kept as is
+type RoomUpdate struct {
+	Title    *string          `json:"title,omitempty"`
+	Topic    *string          `json:"topic,omitempty"`
+	Metadata *json.RawMessage `json:"metadata,omitempty"`
+
+	PollCreators *string `json:"poll_creators,omitempty"` // everyone or moderators
+}
+
+const (
+	maxRoomTitleLength    = 100
+	maxRoomTopicLength    = 500
+	maxRoomMetadataLength = 4096
+)
+
+// Validate checks room update limits
+func (update RoomUpdate) Validate() error {
+	if update.Title != nil && utf8.RuneCountInString(*update.Title) > maxRoomTitleLength {
+		return fmt.Errorf("title is longer than %d characters", maxRoomTitleLength)
+	}
+	if update.Topic != nil && utf8.RuneCountInString(*update.Topic) > maxRoomTopicLength {
+		return fmt.Errorf("topic is longer than %d characters", maxRoomTopicLength)
+	}
+	if update.Metadata != nil && len(*update.Metadata) > maxRoomMetadataLength {
+		return fmt.Errorf("metadata is larger than %d bytes", maxRoomMetadataLength)
+	}
+	if update.PollCreators != nil && *update.PollCreators != pollCreatorsEveryone && *update.PollCreators != pollCreatorsModerators {
+		return errors.New("poll_creators must be everyone or moderators")
+	}
+	return nil
+}
+
+// Update applies room update and broadcasts room_update event to everyone
+func (r *Room) Update(update RoomUpdate) error {
+	if err := update.Validate(); err != nil {
+		return err
+	}
+	r.infoLock.Lock()
+	if update.Title != nil {
+		r.title = *update.Title
+	}
+	if update.Topic != nil {
+		r.topic = *update.Topic
+	}
+	if update.Metadata != nil {
+		r.metadata = *update.Metadata
+	}
+	r.infoLock.Unlock()
+	if update.PollCreators != nil {
+		r.pollsLock.Lock()
+		r.pollCreators = *update.PollCreators
+		r.pollsLock.Unlock()
 	}
+	return r.BroadcastEvent(Event{Type: "room_update", Room: r.Wrap(nil)}, nil)
 }
 
 // NewRoom creates new room
-func NewRoom(name string) *Room {
+func NewRoom(name string, options RoomOptions) *Room {
 	return &Room{
+		options:   options,
 		broadcast: make(chan broadcastMsg),
 		join:      make(chan *User),
 		leave:     make(chan *User),
+		detach:    make(chan *User),
+		kick:      make(chan kickMsg),
+		closed:    make(chan struct{}),
+		gc:        make(chan chan bool),
 		users:     make(map[string]*User),
+		lobby:     make(map[string]*User),
 		Name:      name,
+
+		pollCreators: pollCreatorsEveryone,
+		state:        make(map[string]*StateEntry),
 	}
 }
 
 // GetUsers converts map[int64]*User to list
 func (r *Room) GetUsers() []*User {
+	r.usersLock.RLock()
+	defer r.usersLock.RUnlock()
 	users := []*User{}
 	for _, user := range r.users {
 		users = append(users, user)
@@ -68,6 +270,8 @@ func (r *Room) GetUsers() []*User {
 
 // GetOtherUsers returns other users of room except current
 func (r *Room) GetOtherUsers(user *User) []*User {
+	r.usersLock.RLock()
+	defer r.usersLock.RUnlock()
 	users := []*User{}
 	for _, userCandidate := range r.users {
 		if user.ID == userCandidate.ID {
@@ -78,20 +282,75 @@ func (r *Room) GetOtherUsers(user *User) []*User {
 	return users
 }
 
+// GetUser returns room user by id
+func (r *Room) GetUser(userID string) (*User, error) {
+	for _, user := range r.GetUsers() {
+		if user.ID == userID {
+			return user, nil
+		}
+	}
+	return nil, errNotFound
+}
+
 // Join connects user and room
-func (r *Room) Join(user *User) {
-	r.join <- user
+// Returns errRoomClosed if the room has been removed meanwhile
+func (r *Room) Join(user *User) error {
+	select {
+	case r.join <- user:
+		return nil
+	case <-r.closed:
+		return errRoomClosed
+	}
 }
 
 // Leave disconnects user and room
 func (r *Room) Leave(user *User) {
-	r.leave <- user
+	select {
+	case r.leave <- user:
+	case <-r.closed:
+	}
+}
+
+// Detach removes user from the room without closing connection
+func (r *Room) Detach(user *User) {
+	select {
+	case r.detach <- user:
+	case <-r.closed:
+	}
+}
+
+// Kick removes user from the room and closes connection with reason
+func (r *Room) Kick(user *User, reason string) {
+	select {
+	case r.kick <- kickMsg{user: user, reason: reason}:
+	case <-r.closed:
+	}
 }
 
 // Broadcast sends message to everyone except user (if passed)
-func (r *Room) Broadcast(data []byte, user *User) {
-	message := broadcastMsg{data: data, user: user}
-	r.broadcast <- message
+func (r *Room) Broadcast(data []byte, user *User, priority int) {
+	message := broadcastMsg{data: data, user: user, priority: priority}
+	select {
+	case r.broadcast <- message:
+	case <-r.closed:
+	}
+}
+
+// BroadcastEvent sends event to everyone in the room except user (if passed)
+func (r *Room) BroadcastEvent(event Event, user *User) error {
+	json, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	r.Broadcast(json, user, eventPriority(event.Type))
+	return nil
+}
+
+func (r *Room) log(msg ...interface{}) {
+	log.Println(
+		fmt.Sprintf("room %s:", r.Name),
+		fmt.Sprint(msg...),
+	)
 }
 
 // GetUsersCount return users count in the room
@@ -99,29 +358,91 @@ func (r *Room) GetUsersCount() int {
 	return len(r.GetUsers())
 }
 
+// IsEmpty tells if there is nobody in the room, its lobby and breakout rooms
+func (r *Room) IsEmpty() bool {
+	return r.GetUsersCount() == 0 && len(r.GetLobbyUsers()) == 0 && len(r.GetBreakouts()) == 0
+}
+
+// Close stops the room
+func (r *Room) Close() {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+	})
+}
+
+// CloseIfEmpty stops the room unless somebody is in it. As joins are handled
+// by run, nobody can join the room between the check and closing
+func (r *Room) CloseIfEmpty() bool {
+	reply := make(chan bool, 1)
+	select {
+	case r.gc <- reply:
+		return <-reply
+	case <-r.closed:
+		return true
+	}
+}
+
+// removeUser deletes user from the room, returns false if user was not there
+func (r *Room) removeUser(user *User) bool {
+	r.usersLock.Lock()
+	defer r.usersLock.Unlock()
+	if _, ok := r.users[user.ID]; !ok {
+		return false
+	}
+	delete(r.users, user.ID)
+	return true
+}
+
 func (r *Room) run() {
 	for {
 		select {
+		case <-r.closed:
+			return
+		case reply := <-r.gc:
+			// lobby lock keeps new users out of the lobby while closing
+			r.lobbyLock.Lock()
+			empty := len(r.users) == 0 && len(r.lobby) == 0 && len(r.GetBreakouts()) == 0
+			if empty {
+				r.Close()
+			}
+			r.lobbyLock.Unlock()
+			reply <- empty
+			if empty {
+				return
+			}
 		case user := <-r.join:
+			r.usersLock.Lock()
 			r.users[user.ID] = user
+			r.usersLock.Unlock()
+			r.presence.Add(user, r)
 			go user.BroadcastEventJoin()
 		case user := <-r.leave:
-			if _, ok := r.users[user.ID]; ok {
-				delete(r.users, user.ID)
-				close(user.send)
+			if r.removeUser(user) {
+				r.presence.Remove(user, r)
+				user.Disconnect("")
+				go user.BroadcastEventLeave()
+			}
+		case user := <-r.detach:
+			if r.removeUser(user) {
+				r.presence.Remove(user, r)
+				go r.BroadcastEvent(Event{Type: "user_leave", User: user.Wrap()}, user)
+			}
+		case message := <-r.kick:
+			if r.removeUser(message.user) {
+				r.presence.Remove(message.user, r)
+				message.user.Disconnect(message.reason)
+				go message.user.BroadcastEventLeave()
 			}
-			go user.BroadcastEventLeave()
 		case message := <-r.broadcast:
+			// run is the only writer of users, so reading them here needs no lock
 			for _, user := range r.users {
 				// message will be broadcasted to everyone, except this user
 				if message.user != nil && user.ID == message.user.ID {
 					continue
 				}
-				select {
-				case user.send <- message.data:
-				default:
-					close(user.send)
-					delete(r.users, user.ID)
+				// lagging user is disconnected by send queue and leaves the room when connection closes
+				if err := user.send.Push(message.data, message.priority); err == errLagging {
+					user.log("disconnected, send queue is full")
 				}
 			}
 		}
@@ -130,34 +451,52 @@ func (r *Room) run() {
 
 // Rooms is a set of rooms
 type Rooms struct {
-	rooms map[string]*Room
+	rooms    map[string]*Room
+	presence *Presence
+	invites  *Invites
+	chatLog  *ChatLog
+	files    *Files
+	lock     sync.RWMutex
 }
 
-var errNotFound = errors.New("not found")
+var (
+	errNotFound   = errors.New("not found")
+	errRoomClosed = errors.New("room is closed")
+)
 
 // Get room by room id
 func (r *Rooms) Get(roomID string) (*Room, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
 	if room, exists := r.rooms[roomID]; exists {
 		return room, nil
 	}
 	return nil, errNotFound
 }
 
-// GetOrCreate creates room if it does not exist
-func (r *Rooms) GetOrCreate(roomID string) *Room {
-	room, err := r.Get(roomID)
-	if err == nil {
-		return room
+// GetOrCreate creates room if it does not exist.
+// Options are applied only when a new room is created.
+// Chat history is loaded outside of rooms lock, callers wait only for their room
+func (r *Rooms) GetOrCreate(roomID string, options RoomOptions) *Room {
+	r.lock.Lock()
+	room, exists := r.rooms[roomID]
+	if !exists {
+		room = NewRoom(roomID, options)
+		room.presence = r.presence
+		room.invites = r.invites
+		room.chatLog = r.chatLog
+		r.rooms[roomID] = room
+		go room.run()
 	}
-	newRoom := NewRoom(roomID)
-	r.AddRoom(roomID, newRoom)
-	go newRoom.run()
-	return newRoom
-
+	r.lock.Unlock()
+	room.historyOnce.Do(room.LoadChatHistory)
+	return room
 }
 
 // AddRoom adds room to rooms list
 func (r *Rooms) AddRoom(roomID string, room *Room) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	if _, exists := r.rooms[roomID]; exists {
 		return errors.New("room with id " + roomID + " already exists")
 	}
@@ -167,6 +506,8 @@ func (r *Rooms) AddRoom(roomID string, room *Room) error {
 
 // RemoveRoom remove room from rooms list
 func (r *Rooms) RemoveRoom(roomID string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	if _, exists := r.rooms[roomID]; exists {
 		delete(r.rooms, roomID)
 		return nil
@@ -180,21 +521,75 @@ type RoomsStats struct {
 	Rooms  []*RoomWrap `json:"rooms"`
 }
 
-// GetStats get app statistics
-func (r *Rooms) GetStats() RoomsStats {
+// GetStats get app statistics of rooms visible to caller
+func (r *Rooms) GetStats(visible func(roomID string) bool) RoomsStats {
 	stats := RoomsStats{
 		Rooms: []*RoomWrap{},
 	}
-	for _, room := range r.rooms {
+	for _, room := range r.List() {
+		if !visible(room.Name) {
+			continue
+		}
 		stats.Online += room.GetUsersCount()
 		stats.Rooms = append(stats.Rooms, room.Wrap(nil))
 	}
 	return stats
 }
 
-// NewRooms creates rooms instance
-func NewRooms() *Rooms {
+// List returns all rooms
+func (r *Rooms) List() []*Room {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	rooms := []*Room{}
+	for _, room := range r.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// Watch removes rooms that stay empty for emptyRoomTTL, together with their files.
+// Chat log is kept
+func (r *Rooms) Watch() {
+	emptySince := make(map[*Room]time.Time)
+	for range time.Tick(roomsCheckPeriod) {
+		for _, room := range r.List() {
+			if !room.IsEmpty() {
+				delete(emptySince, room)
+				continue
+			}
+			since, exists := emptySince[room]
+			if !exists {
+				emptySince[room] = time.Now()
+				continue
+			}
+			if time.Since(since) < emptyRoomTTL {
+				continue
+			}
+			delete(emptySince, room)
+			// users joining get the room from GetOrCreate under the same lock,
+			// and retry if they find it closed
+			r.lock.Lock()
+			if !room.CloseIfEmpty() {
+				r.lock.Unlock()
+				continue
+			}
+			delete(r.rooms, room.Name)
+			r.lock.Unlock()
+			if err := r.files.RemoveRoom(room.Name); err != nil {
+				room.log(err)
+			}
+			room.log("removed after being empty for ", emptyRoomTTL)
+		}
+	}
+}
+
+// NewRooms creates rooms instance. Chat is not persisted if chat log is nil
+func NewRooms(chatLog *ChatLog, files *Files) *Rooms {
 	return &Rooms{
-		rooms: make(map[string]*Room, 100),
+		rooms:    make(map[string]*Room, 100),
+		presence: NewPresence(),
+		invites:  NewInvites(),
+		chatLog:  chatLog,
+		files:    files,
 	}
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Priorities of outbound messages, higher ones are sent first
+const (
+	priorityLow    = iota // reactions, shed first under backpressure
+	priorityNormal        // chat and room events
+	priorityHigh          // signaling
+	priorityCount
+)
+
+const (
+	// Messages queued for user before client gets lagging notice
+	// and low priority messages are shed.
+	sendQueueHighWater = 192
+	// Messages queued for user before disconnecting, if there is nothing to shed.
+	sendQueueSize = 256
+)
+
+var (
+	errLagging = errors.New("lagging")
+
+	laggingNotice = []byte(`{"type":"lagging"}`)
+)
+
+// eventPriority returns outbound queue priority of event type
+func eventPriority(eventType string) int {
+	switch eventType {
+	case "offer", "answer", "candidate":
+		return priorityHigh
+	case "reaction":
+		return priorityLow
+	}
+	return priorityNormal
+}
+
+// sendQueue is outbound message queue of user websocket connection.
+// Messages are sent highest priority first. When client does not keep up,
+// it gets a `lagging` notice and low priority messages are dropped.
+// If the queue is still full and there is nothing left to drop, it is closed
+type sendQueue struct {
+	queues  [priorityCount][][]byte
+	size    int
+	lagging bool // lagging notice is sent, cleared when queue drains
+	closed  bool
+	reason  string        // sent to client in websocket close frame
+	ready   chan struct{} // signals writer that there are messages or queue is closed
+	lock    sync.Mutex
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Push adds message to the queue, never blocks.
+// Returns errLagging if the queue has overflown and is closed now
+func (q *sendQueue) Push(message []byte, priority int) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return errChanClosed
+	}
+	if q.size >= sendQueueHighWater {
+		if !q.lagging {
+			// notice goes first, client has the rest of the queue to catch up
+			q.lagging = true
+			q.queues[priorityHigh] = append([][]byte{laggingNotice}, q.queues[priorityHigh]...)
+			q.size++
+		}
+		if priority == priorityLow {
+			atomic.AddUint64(&metrics.sendQueueEvictions, 1)
+			return nil
+		}
+	}
+	if q.size >= sendQueueSize {
+		if len(q.queues[priorityLow]) == 0 {
+			q.closed = true
+			q.reason = errLagging.Error()
+			q.signal()
+			return errLagging
+		}
+		q.queues[priorityLow] = q.queues[priorityLow][1:]
+		q.size--
+		atomic.AddUint64(&metrics.sendQueueEvictions, 1)
+	}
+	q.queues[priority] = append(q.queues[priority], message)
+	q.size++
+	q.signal()
+	return nil
+}
+
+// Pop takes the oldest message of the highest priority.
+// Returns false if the queue is empty
+func (q *sendQueue) Pop() ([]byte, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for priority := priorityCount - 1; priority >= 0; priority-- {
+		if len(q.queues[priority]) == 0 {
+			continue
+		}
+		message := q.queues[priority][0]
+		q.queues[priority] = q.queues[priority][1:]
+		q.size--
+		if q.size < sendQueueSize/2 {
+			q.lagging = false
+		}
+		return message, true
+	}
+	return nil, false
+}
+
+// Close stops accepting messages. Queued ones are still sent, then connection is closed with reason
+func (q *sendQueue) Close(reason string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.reason = reason
+	q.signal()
+}
+
+// Done tells if queue is closed and all messages are taken, with the close reason
+func (q *sendQueue) Done() (bool, string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.closed && q.size == 0, q.reason
+}
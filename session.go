@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SessionPolicy decides what happens when the same identity joins a room twice
+type SessionPolicy string
+
+const (
+	sessionPolicyAllow     SessionPolicy = "allow"      // keep both sessions
+	sessionPolicyKickOld   SessionPolicy = "kick_old"   // disconnect older session
+	sessionPolicyRejectNew SessionPolicy = "reject_new" // refuse newer connection
+)
+
+var (
+	errAlreadyConnected   = errors.New("already connected from another device")
+	errConnectedElsewhere = errors.New("connected from another device")
+)
+
+// sessionPolicy is configured with SESSION_POLICY env variable
+var sessionPolicy = sessionPolicyAllow
+
+// ParseSessionPolicy validates policy name, empty name means allow
+func ParseSessionPolicy(name string) (SessionPolicy, error) {
+	switch policy := SessionPolicy(name); policy {
+	case "":
+		return sessionPolicyAllow, nil
+	case sessionPolicyAllow, sessionPolicyKickOld, sessionPolicyRejectNew:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown session policy %q", name)
+}
+
+// FindUsersByIdentity returns sessions of identity in the room,
+// its breakout rooms and the lobby
+func (r *Room) FindUsersByIdentity(identity string) []*User {
+	users := []*User{}
+	for _, room := range append([]*Room{r}, r.GetBreakouts()...) {
+		for _, user := range append(room.GetUsers(), room.GetLobbyUsers()...) {
+			if user.identity == identity {
+				users = append(users, user)
+			}
+		}
+	}
+	return users
+}
+
+// Kick disconnects user with reason wherever user is: room, breakout room or lobby
+func (u *User) Kick(reason string) {
+	if u.Room().LeaveLobby(u) {
+		u.Disconnect(reason)
+		return
+	}
+	u.Room().Kick(u, reason)
+}
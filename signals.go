@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+const (
+	// Hand raises and reactions allowed per second after burst is spent.
+	signalRate = 1
+	// Hand raises and reactions user can send at once.
+	signalBurst = 5
+	// Maximum length of reaction emoji in characters, enough for joined sequences.
+	maxReactionLength = 8
+)
+
+var errRateLimited = errors.New("too many events, slow down")
+
+// HandleSignal handles ephemeral room signals: raised hands and reactions
+func (u *User) HandleSignal(event *Event) error {
+	if !u.CanChat() {
+		return errForbidden
+	}
+	if !u.signalLimiter.Allow() {
+		return errRateLimited
+	}
+	switch event.Type {
+	case "raise_hand":
+		return u.RaiseHand()
+	case "lower_hand":
+		return u.LowerHand(event.Target)
+	case "reaction":
+		return u.React(event.Emoji)
+	}
+	return errNotImplemented
+}
+
+// RaiseHand raises user hand. In stage rooms it asks moderators to invite user to stage
+func (u *User) RaiseHand() error {
+	u.infoLock.Lock()
+	u.info.Hand = true
+	u.infoLock.Unlock()
+	return u.Room().BroadcastEvent(Event{Type: "raise_hand", User: u.Wrap()}, nil)
+}
+
+// LowerHand lowers user hand. Moderators can lower hand of target user
+func (u *User) LowerHand(targetID string) error {
+	target := u
+	if targetID != "" && targetID != u.ID {
+		if !u.IsModerator() {
+			return errForbidden
+		}
+		var err error
+		target, err = u.Room().GetUser(targetID)
+		if err != nil {
+			return err
+		}
+	}
+	target.infoLock.Lock()
+	target.info.Hand = false
+	target.infoLock.Unlock()
+	return u.Room().BroadcastEvent(Event{Type: "lower_hand", User: target.Wrap()}, nil)
+}
+
+// React sends emoji reaction to everyone in the room
+func (u *User) React(emoji string) error {
+	if emoji == "" || utf8.RuneCountInString(emoji) > maxReactionLength {
+		return errors.New("invalid reaction emoji")
+	}
+	return u.BroadcastEvent(Event{Type: "reaction", User: u.Wrap(), Emoji: emoji})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+)
+
+var (
+	errForbidden = errors.New("forbidden")
+	errNoStage   = errors.New("room has no stage")
+)
+
+// GetInTrackSSRCs returns ssrcs of user incoming tracks
+func (u *User) GetInTrackSSRCs() []uint32 {
+	u.inTracksLock.RLock()
+	defer u.inTracksLock.RUnlock()
+	ssrcs := []uint32{}
+	for ssrc := range u.inTracks {
+		ssrcs = append(ssrcs, ssrc)
+	}
+	return ssrcs
+}
+
+// publishTracks attaches user tracks to everyone else in the room and renegotiates
+func (u *User) publishTracks(ssrcs []uint32) {
+	if len(ssrcs) == 0 {
+		return
+	}
+	for _, roomUser := range u.Room().GetOtherUsers(u) {
+		if !roomUser.CanSubscribe() {
+			continue
+		}
+		for _, ssrc := range ssrcs {
+			u.log("add remote track ", ssrc, " to user ", roomUser.ID)
+			if err := roomUser.AddTrack(ssrc); err != nil {
+				u.log(err)
+			}
+		}
+		if err := roomUser.SendOffer(); err != nil && err != errChanClosed {
+			u.log(err)
+		}
+	}
+}
+
+// unpublishTracks detaches user tracks from everyone else in the room and renegotiates
+func (u *User) unpublishTracks(ssrcs []uint32) {
+	if len(ssrcs) == 0 {
+		return
+	}
+	for _, roomUser := range u.Room().GetOtherUsers(u) {
+		removed := false
+		for _, sender := range roomUser.pc.GetSenders() {
+			if sender.Track() == nil {
+				continue
+			}
+			for _, ssrc := range ssrcs {
+				if sender.Track().SSRC() != ssrc {
+					continue
+				}
+				if err := roomUser.pc.RemoveTrack(sender); err != nil {
+					u.log(err)
+					continue
+				}
+				removed = true
+			}
+		}
+		roomUser.outTracksLock.Lock()
+		for _, ssrc := range ssrcs {
+			delete(roomUser.outTracks, ssrc)
+		}
+		roomUser.outTracksLock.Unlock()
+		if removed {
+			if err := roomUser.SendOffer(); err != nil && err != errChanClosed {
+				u.log(err)
+			}
+		}
+	}
+}
+
+// InviteToStage gives target user rights to publish audio.
+// Only moderators can invite to stage
+func (u *User) InviteToStage(targetID string) error {
+	if !u.Room().options.Stage {
+		return errNoStage
+	}
+	if !u.IsModerator() {
+		return errForbidden
+	}
+	target, err := u.Room().GetUser(targetID)
+	if err != nil {
+		return err
+	}
+	permissions := target.GetPermissions()
+	if permissions.Publish {
+		return nil
+	}
+	permissions.Publish = true
+	if err := target.SetPermissions(permissions); err != nil {
+		return err
+	}
+	return u.Room().BroadcastEvent(Event{Type: "invite_to_stage", User: target.Wrap()}, nil)
+}
+
+// MoveToAudience takes away rights to publish audio from target user.
+// Moderators can move anyone, others can only leave the stage themselves
+func (u *User) MoveToAudience(targetID string) error {
+	if !u.Room().options.Stage {
+		return errNoStage
+	}
+	target := u
+	if targetID != "" && targetID != u.ID {
+		if !u.IsModerator() {
+			return errForbidden
+		}
+		var err error
+		target, err = u.Room().GetUser(targetID)
+		if err != nil {
+			return err
+		}
+	}
+	permissions := target.GetPermissions()
+	if !permissions.Publish {
+		return nil
+	}
+	permissions.Publish = false
+	if err := target.SetPermissions(permissions); err != nil {
+		return err
+	}
+	return u.Room().BroadcastEvent(Event{Type: "move_to_audience", User: target.Wrap()}, nil)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// Maximum keys in room state.
+	maxStateKeys = 256
+	// Maximum state key length in bytes.
+	maxStateKeyLength = 128
+	// Maximum state value size in bytes.
+	maxStateValueSize = 16384
+)
+
+var errVersionMismatch = errors.New("version_mismatch")
+
+// StateEntry is a value of room state key
+type StateEntry struct {
+	Value   json.RawMessage `json:"value"`   // null for deleted key
+	Version int64           `json:"version"` // room state version of the last change
+}
+
+// StateSet changes a key of room state.
+// If version is set the key is changed only if it still has this version,
+// zero version means key must not exist
+type StateSet struct {
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value"` // null deletes the key
+	Version *int64          `json:"version,omitempty"`
+}
+
+// GetState returns copy of the whole room state
+func (r *Room) GetState() map[string]*StateEntry {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+	state := make(map[string]*StateEntry, len(r.state))
+	for key, entry := range r.state {
+		state[key] = entry
+	}
+	return state
+}
+
+// SetState applies compare-and-set change to room state.
+// Returns changed entry, or current entry and errVersionMismatch
+func (r *Room) SetState(set StateSet) (*StateEntry, error) {
+	if set.Key == "" || len(set.Key) > maxStateKeyLength {
+		return nil, fmt.Errorf("key must be 1 to %d bytes", maxStateKeyLength)
+	}
+	if len(set.Value) > maxStateValueSize {
+		return nil, fmt.Errorf("value is larger than %d bytes", maxStateValueSize)
+	}
+	deleted := len(set.Value) == 0 || string(set.Value) == "null"
+
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+	current, exists := r.state[set.Key]
+	if set.Version != nil {
+		currentVersion := int64(0)
+		if exists {
+			currentVersion = current.Version
+		}
+		if *set.Version != currentVersion {
+			if !exists {
+				current = &StateEntry{Value: json.RawMessage("null")}
+			}
+			return current, errVersionMismatch
+		}
+	}
+	if !exists && !deleted && len(r.state) >= maxStateKeys {
+		return nil, fmt.Errorf("room state has %d keys already", maxStateKeys)
+	}
+	r.stateVersion++
+	entry := &StateEntry{Value: set.Value, Version: r.stateVersion}
+	if deleted {
+		entry.Value = json.RawMessage("null")
+		delete(r.state, set.Key)
+	} else {
+		r.state[set.Key] = entry
+	}
+	return entry, nil
+}
+
+// HandleStateSet changes room state and broadcasts state_patch to everyone.
+// On version mismatch user gets current value of the key in state_patch
+func (u *User) HandleStateSet(set *StateSet) error {
+	if set == nil {
+		return errors.New("empty state_set")
+	}
+	if !u.CanChat() {
+		return errForbidden
+	}
+	if !u.signalLimiter.Allow() {
+		return errRateLimited
+	}
+	entry, err := u.Room().SetState(*set)
+	if err == errVersionMismatch {
+		if err := u.SendEvent(Event{Type: "state_patch", State: map[string]*StateEntry{set.Key: entry}}); err != nil {
+			return err
+		}
+		return errVersionMismatch
+	}
+	if err != nil {
+		return err
+	}
+	return u.Room().BroadcastEvent(Event{Type: "state_patch", State: map[string]*StateEntry{set.Key: entry}}, nil)
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	cryptorand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -57,53 +60,120 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
+	Subprotocols: []string{tokenSubprotocol},
 }
 
 // User is a middleman between the websocket connection and the hub.
 type User struct {
 	ID            string
-	room          *Room
+	identity      string // stable identity across sessions, empty for anonymous users
+	secret        string // session secret for http api, known only to the user
+	nameLocked    bool   // name comes from token claims and can not be changed
+	ip            string
+	room          *Room // changes when user moves to breakout rooms, use Room()
+	roomLock      sync.RWMutex
+	moveLock      sync.Mutex               // one move between rooms at a time
 	conn          *websocket.Conn          // The websocket connection.
-	send          chan []byte              // Buffered channel of outbound messages.
+	send          *sendQueue               // Outbound messages by priority.
 	pc            *webrtc.PeerConnection   // WebRTC Peer Connection
 	inTracks      map[uint32]*webrtc.Track // Microphone
 	inTracksLock  sync.RWMutex
 	outTracks     map[uint32]*webrtc.Track // Rest of the room's tracks
 	outTracksLock sync.RWMutex
 
+	dataChannels     map[string]*webrtc.DataChannel // opened by client, by relay mode
+	dataChannelsLock sync.RWMutex
+
 	rtpCh chan *rtp.Packet
 
+	signalLimiter *tokenBucket // limits hand raises and reactions
+	chatLimiter   *tokenBucket
+	relayLimiter  *tokenBucket // limits data channel messages
+	lastActive    int64        // unix nano time of the last event or audio, accessed atomically
+
 	stop bool
 
-	info UserInfo
+	info     UserInfo
+	infoLock sync.RWMutex
 }
 
+const (
+	roleModerator = "moderator"
+	roleUser      = "user"
+)
+
 // UserInfo contains some user data
 type UserInfo struct {
-	Emoji string `json:"emoji"` // emoji-face like on clients (for test)
-	Mute  bool   `json:"mute"`
+	Emoji  string `json:"emoji"` // emoji-face like on clients (for test)
+	Name   string `json:"name,omitempty"`
+	Avatar string `json:"avatar,omitempty"`
+	Mute   bool   `json:"mute"`
+	Role   string `json:"role"` // moderator or user
+	Hand   bool   `json:"hand"` // raised hand, in stage rooms asks to be invited to stage
+	Away   bool   `json:"away"` // no activity for awayTimeout
+
+	MuteLocked bool `json:"mute_locked,omitempty"` // muted by moderator, user can not unmute
+
+	Permissions Permissions `json:"permissions"`
+
+	Attributes map[string]string `json:"attributes,omitempty"` // custom client defined data
 }
 
 // UserWrap represents user object sent to client
 type UserWrap struct {
-	ID string `json:"id"`
+	ID       string `json:"id"`
+	Identity string `json:"identity,omitempty"`
 	UserInfo
 }
 
 // Wrap wraps user
 func (u *User) Wrap() *UserWrap {
+	u.infoLock.RLock()
+	defer u.infoLock.RUnlock()
 	return &UserWrap{
 		ID:       u.ID,
+		Identity: u.identity,
 		UserInfo: u.info,
 	}
 }
 
+// newID generates random id for sessions, invites and messages
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := cryptorand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// IsModerator reports whether user can manage the room
+func (u *User) IsModerator() bool {
+	u.infoLock.RLock()
+	defer u.infoLock.RUnlock()
+	return u.info.Role == roleModerator
+}
+
+// Room returns the room user is in
+func (u *User) Room() *Room {
+	u.roomLock.RLock()
+	defer u.roomLock.RUnlock()
+	return u.room
+}
+
+func (u *User) setRoom(room *Room) {
+	u.roomLock.Lock()
+	defer u.roomLock.Unlock()
+	u.room = room
+}
+
 // readPump pumps messages from the websocket connection to the hub.
 func (u *User) readPump() {
 	defer func() {
 		u.stop = true
 		u.pc.Close()
-		u.room.Leave(u)
+		if !u.Room().LeaveLobby(u) {
+			u.Room().Leave(u)
+		}
 		u.conn.Close()
 	}()
 	u.conn.SetReadLimit(maxMessageSize)
@@ -119,6 +189,7 @@ func (u *User) readPump() {
 			}
 			break
 		}
+		u.Touch()
 		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
 		go func() {
 			err := u.HandleEvent(message)
@@ -144,19 +215,26 @@ func (u *User) writePump() {
 	}()
 	for {
 		select {
-		case message, ok := <-u.send:
-			u.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel.
-				u.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-			w, err := u.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
+		case <-u.send.ready:
+			for {
+				message, ok := u.send.Pop()
+				if !ok {
+					break
+				}
+				u.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				w, err := u.conn.NextWriter(websocket.TextMessage)
+				if err != nil {
+					return
+				}
+				w.Write(message)
+				if err := w.Close(); err != nil {
+					return
+				}
 			}
-			w.Write(message)
-			if err := w.Close(); err != nil {
+			if done, reason := u.send.Done(); done {
+				// The queue is closed.
+				u.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				u.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason))
 				return
 			}
 		case <-ticker.C:
@@ -178,26 +256,50 @@ type Event struct {
 	User      *UserWrap                  `json:"user,omitempty"`
 	Room      *RoomWrap                  `json:"room,omitempty"`
 	Desc      string                     `json:"desc,omitempty"`
-}
-
-// SendEvent sends json body to web socket
+	Target    string                     `json:"target,omitempty"` // id of the user moderator action is applied to
+	Breakouts *BreakoutsConfig           `json:"breakouts,omitempty"`
+	Update    *RoomUpdate                `json:"update,omitempty"`
+	Ban       *Ban                       `json:"ban,omitempty"`
+	Profile   *Profile                   `json:"profile,omitempty"`
+	Emoji     string                     `json:"emoji,omitempty"`
+	Message   *Message                   `json:"message,omitempty"`
+	File      *File                      `json:"file,omitempty"`
+	App       *AppEvent                  `json:"app,omitempty"`
+	Poll      *Poll                      `json:"poll,omitempty"`
+	Vote      *Vote                      `json:"vote,omitempty"`
+	Set       *StateSet                  `json:"set,omitempty"`
+	State     map[string]*StateEntry     `json:"state,omitempty"`
+	Invite    *InviteWrap                `json:"invite,omitempty"`
+
+	InviteRequest *InviteRequest `json:"invite_request,omitempty"`
+
+	Permissions *Permissions `json:"permissions,omitempty"`
+	Secret      string       `json:"secret,omitempty"` // session secret, sent only to its user
+}
+
+// SendEvent queues json body for web socket, never blocks
 func (u *User) SendEvent(event Event) error {
 	json, err := json.Marshal(event)
 	if err != nil {
 		return err
 	}
-	u.send <- json
-	return nil
+	return u.send.Push(json, eventPriority(event.Type))
 }
 
-// SendEventUser sends user to client to identify himself
+// Disconnect closes user connection once all queued messages are sent.
+// Reason is passed to client in the close frame
+func (u *User) Disconnect(reason string) {
+	u.send.Close(reason)
+}
+
+// SendEventUser sends user to client to identify himself, with session secret
 func (u *User) SendEventUser() error {
-	return u.SendEvent(Event{Type: "user", User: u.Wrap()})
+	return u.SendEvent(Event{Type: "user", User: u.Wrap(), Secret: u.secret})
 }
 
-// SendEventRoom sends room to client with users except me
+// SendEventRoom sends room to client with users except me and room state
 func (u *User) SendEventRoom() error {
-	return u.SendEvent(Event{Type: "room", Room: u.room.Wrap(u)})
+	return u.SendEvent(Event{Type: "room", Room: u.Room().Wrap(u), State: u.Room().GetState()})
 }
 
 // BroadcastEvent sends json body to everyone in the room except this user
@@ -206,7 +308,7 @@ func (u *User) BroadcastEvent(event Event) error {
 	if err != nil {
 		return err
 	}
-	u.room.Broadcast(json, u)
+	u.Room().Broadcast(json, u, eventPriority(event.Type))
 	return nil
 }
 
@@ -242,6 +344,20 @@ func (u *User) log(msg ...interface{}) {
 	)
 }
 
+// eventTypes are websocket events counted in metrics by type, others are counted
+// as unknown, so that clients can not use up labels
+var eventTypes = map[string]bool{
+	"offer": true, "answer": true, "candidate": true, "mute": true, "unmute": true,
+	"raise_hand": true, "lower_hand": true, "reaction": true, "chat": true,
+	"direct_message": true, "edit_message": true, "delete_message": true,
+	"invite_to_stage": true, "move_to_audience": true, "admit": true, "deny": true,
+	"open_breakouts": true, "close_breakouts": true, "update_room": true, "lock": true,
+	"unlock": true, "ban": true, "unban": true, "update_profile": true,
+	"set_permissions": true, "app": true, "create_poll": true, "vote": true,
+	"close_poll": true, "state_set": true, "create_invite": true, "revoke_invite": true,
+	"ping": true,
+}
+
 // HandleEvent handles user event
 func (u *User) HandleEvent(eventRaw []byte) error {
 	var event *Event
@@ -250,7 +366,16 @@ func (u *User) HandleEvent(eventRaw []byte) error {
 		return err
 	}
 	u.log("handle event", event.Type)
-	if event.Type == "offer" {
+	if eventTypes[event.Type] {
+		metrics.events.Inc(event.Type)
+	} else {
+		metrics.events.Inc("unknown")
+	}
+	if u.Room().IsWaiting(u) {
+		return errWaiting
+	}
+	switch event.Type {
+	case "offer":
 		if event.Offer == nil {
 			return u.SendErr(errors.New("empty offer"))
 		}
@@ -259,37 +384,101 @@ func (u *User) HandleEvent(eventRaw []byte) error {
 			return err
 		}
 		return nil
-	} else if event.Type == "answer" {
+	case "answer":
 		if event.Answer == nil {
 			return u.SendErr(errors.New("empty answer"))
 		}
 		u.pc.SetRemoteDescription(*event.Answer)
 		return nil
-	} else if event.Type == "candidate" {
+	case "candidate":
 		if event.Candidate == nil {
 			return u.SendErr(errors.New("empty candidate"))
 		}
 		u.log("adding candidate")
 		u.pc.AddICECandidate(*event.Candidate)
 		return nil
-	} else if event.Type == "mute" {
-		u.info.Mute = true
-		u.BroadcastEventMute()
-		return nil
-	} else if event.Type == "unmute" {
-		u.info.Mute = false
-		u.BroadcastEventUnmute()
+	case "mute":
+		return u.HandleMute(event.Target)
+	case "unmute":
+		return u.HandleUnmute(event.Target)
+	case "raise_hand", "lower_hand", "reaction":
+		return u.HandleSignal(event)
+	case "chat":
+		return u.HandleChat(event.Message)
+	case "direct_message":
+		return u.HandleDirectMessage(event.Target, event.Message)
+	case "edit_message":
+		return u.HandleEditMessage(event.Message)
+	case "delete_message":
+		return u.HandleDeleteMessage(event.Message)
+	case "invite_to_stage":
+		return u.InviteToStage(event.Target)
+	case "move_to_audience":
+		return u.MoveToAudience(event.Target)
+	case "admit":
+		return u.Admit(event.Target)
+	case "deny":
+		return u.Deny(event.Target, event.Desc)
+	case "open_breakouts":
+		return u.HandleOpenBreakouts(event.Breakouts)
+	case "close_breakouts":
+		return u.HandleCloseBreakouts()
+	case "update_room":
+		if event.Update == nil {
+			return errors.New("empty update")
+		}
+		if !u.CanChangeRoom() {
+			return errForbidden
+		}
+		return u.Room().Update(*event.Update)
+	case "lock":
+		return u.HandleLock(true)
+	case "unlock":
+		return u.HandleLock(false)
+	case "ban":
+		return u.HandleBan(event.Target, event.Ban)
+	case "unban":
+		return u.HandleUnban(event.Ban)
+	case "update_profile":
+		return u.UpdateProfile(event.Profile)
+	case "set_permissions":
+		return u.HandleSetPermissions(event.Target, event.Permissions)
+	case "app":
+		return u.HandleApp(event.App)
+	case "create_poll":
+		return u.CreatePoll(event.Poll)
+	case "vote":
+		return u.HandleVote(event.Vote)
+	case "close_poll":
+		if event.Poll == nil {
+			return errPollNotFound
+		}
+		return u.ClosePoll(event.Poll.ID)
+	case "state_set":
+		return u.HandleStateSet(event.Set)
+	case "create_invite":
+		return u.HandleCreateInvite(event.InviteRequest)
+	case "revoke_invite":
+		return u.HandleRevokeInvite(event.Invite)
+	case "ping":
+		// heartbeat of clients without audio, activity is counted by readPump
 		return nil
 	}
 
 	return u.SendErr(errNotImplemented)
 }
 
-// GetRoomTracks returns list of room incoming tracks
+// GetRoomTracks returns list of room incoming tracks user is allowed to receive
 func (u *User) GetRoomTracks() []*webrtc.Track {
 	tracks := []*webrtc.Track{}
-	for _, user := range u.room.GetUsers() {
-		for _, track := range user.inTracks {
+	if !u.CanSubscribe() {
+		return tracks
+	}
+	for _, user := range u.Room().GetUsers() {
+		if !user.CanPublish() {
+			continue
+		}
+		for _, track := range user.GetInTracks() {
 			tracks = append(tracks, track)
 		}
 	}
@@ -319,8 +508,11 @@ func (u *User) HandleOffer(offer webrtc.SessionDescription) error {
 	if ok := u.supportOpus(offer); !ok {
 		return errors.New("remote peer does not support opus codec")
 	}
+	if !u.CanPublish() && offerPublishesAudio(offer) {
+		return errPublishNotAllowed
+	}
 
-	if len(u.pc.GetTransceivers()) == 0 {
+	if len(u.pc.GetTransceivers()) == 0 && u.CanPublish() {
 		// add receive only transciever to get user microphone audio
 		_, err := u.pc.AddTransceiver(webrtc.RTPCodecTypeAudio, webrtc.RtpTransceiverInit{
 			Direction: webrtc.RTPTransceiverDirectionRecvonly,
@@ -359,10 +551,13 @@ func (u *User) Offer() (webrtc.SessionDescription, error) {
 // SendOffer creates webrtc offer
 func (u *User) SendOffer() error {
 	offer, err := u.Offer()
-	err = u.SendEvent(Event{Type: "offer", Offer: &offer})
 	if err != nil {
-		panic(err)
+		return err
 	}
+	if err := u.SendEvent(Event{Type: "offer", Offer: &offer}); err != nil {
+		return err
+	}
+	atomic.AddUint64(&metrics.renegotiations, 1)
 	return nil
 }
 
@@ -415,6 +610,10 @@ func (u *User) receiveInTrackRTP(remoteTrack *webrtc.Track) {
 			}
 			log.Fatalf("rtp err => %v", err)
 		}
+		atomic.AddUint64(&metrics.rtpPacketsReceived, 1)
+		atomic.AddUint64(&metrics.rtpBytesReceived, uint64(len(rtp.Raw)))
+		// muted users and stage listeners are still here while their client sends audio
+		u.Touch()
 		u.rtpCh <- rtp
 	}
 }
@@ -439,6 +638,7 @@ func (u *User) WriteRTP(pkt *rtp.Packet) error {
 
 	if track == nil {
 		log.Printf("WebRTCTransport.WriteRTP track==nil pkt.SSRC=%d", pkt.SSRC)
+		atomic.AddUint64(&metrics.invalidTrack, 1)
 		return errInvalidTrack
 	}
 
@@ -446,9 +646,11 @@ func (u *User) WriteRTP(pkt *rtp.Packet) error {
 	err := track.WriteRTP(pkt)
 	if err != nil {
 		// log.Errorf(err.Error())
-		// u.writeErrCnt++
+		atomic.AddUint64(&metrics.rtpWriteErrors, 1)
 		return err
 	}
+	atomic.AddUint64(&metrics.rtpPacketsForwarded, 1)
+	atomic.AddUint64(&metrics.rtpBytesForwarded, uint64(len(pkt.Raw)))
 	return nil
 }
 
@@ -458,7 +660,11 @@ func (u *User) broadcastIncomingRTP() {
 		if err != nil {
 			panic(err)
 		}
-		for _, user := range u.room.GetOtherUsers(u) {
+		if !u.CanPublish() || u.IsMuted() {
+			// audio of listeners and muted users is never forwarded to the room
+			continue
+		}
+		for _, user := range u.Room().GetOtherUsers(u) {
 			err := user.WriteRTP(rtp)
 			if err != nil {
 				// panic(err)
@@ -483,13 +689,22 @@ func (u *User) GetOutTracks() map[uint32]*webrtc.Track {
 	return u.outTracks
 }
 
-// AddTrack adds track to peer connection
+// AddTrack adds track to peer connection.
+// Listeners get send only transceivers, so they are not able to publish on them
 func (u *User) AddTrack(ssrc uint32) error {
-	track, err := u.pc.NewTrack(webrtc.DefaultPayloadTypeOpus, ssrc, string(ssrc), string(ssrc))
+	id := strconv.FormatUint(uint64(ssrc), 10)
+	track, err := u.pc.NewTrack(webrtc.DefaultPayloadTypeOpus, ssrc, id, id)
 	if err != nil {
 		return err
 	}
-	if _, err := u.pc.AddTrack(track); err != nil {
+	if u.CanPublish() {
+		_, err = u.pc.AddTrack(track)
+	} else {
+		_, err = u.pc.AddTransceiverFromTrack(track, webrtc.RtpTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionSendonly,
+		})
+	}
+	if err != nil {
 		log.Println("ERROR Add remote track as peerConnection local track", err)
 		return err
 	}
@@ -513,7 +728,76 @@ func (u *User) Watch() {
 }
 
 // serveWs handles websocket requests from the peer.
-func serveWs(rooms *Rooms, w http.ResponseWriter, r *http.Request) {
+// When auth is configured, connections without valid token are rejected
+// before the upgrade. Invite token (`?invite=`) is accepted instead of auth token
+// and lets guests into locked rooms and past the lobby.
+func serveWs(rooms *Rooms, auth *Auth, w http.ResponseWriter, r *http.Request) {
+	roomID := strings.ReplaceAll(r.URL.Path, "/", "")
+	ip := remoteIP(r)
+
+	var invite *Invite
+	if token := r.URL.Query().Get("invite"); token != "" {
+		var err error
+		invite, err = rooms.invites.Verify(token, roomID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	var claims *Claims
+	if auth != nil && invite == nil {
+		var err error
+		claims, err = auth.Authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !claims.CanJoin(roomID) {
+			http.Error(w, errRoomNotAllowed.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	identity := ""
+	if claims != nil {
+		identity = claims.Subject
+	}
+	profile, err := ProfileFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := profile.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if room, err := rooms.Get(roomID); err == nil {
+		bannedIP := ip
+		if claims != nil && claims.Role == roleModerator {
+			// moderators are banned only by identity, see AddBan
+			bannedIP = ""
+		}
+		if room.IsBanned(identity, bannedIP) {
+			http.Error(w, errBanned.Error(), http.StatusForbidden)
+			return
+		}
+		if room.IsLocked() && invite == nil && (claims == nil || claims.Role != roleModerator) {
+			http.Error(w, errLocked.Error(), http.StatusForbidden)
+			return
+		}
+		if identity != "" && sessionPolicy == sessionPolicyRejectNew && len(room.FindUsersByIdentity(identity)) > 0 {
+			http.Error(w, errAlreadyConnected.Error(), http.StatusConflict)
+			return
+		}
+	}
+	if invite != nil {
+		if err := rooms.invites.Use(invite.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
@@ -526,8 +810,7 @@ func serveWs(rooms *Rooms, w http.ResponseWriter, r *http.Request) {
 	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
 	peerConnection, err := api.NewPeerConnection(peerConnectionConfig)
 
-	roomID := strings.ReplaceAll(r.URL.Path, "/", "")
-	room := rooms.GetOrCreate(roomID)
+	room := rooms.GetOrCreate(roomID, ParseRoomOptions(r.URL.Query()))
 
 	log.Println("ws connection to room:", roomID, len(room.GetUsers()), "users")
 
@@ -537,20 +820,55 @@ func serveWs(rooms *Rooms, w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := &User{
-		ID:        strconv.FormatInt(time.Now().UnixNano(), 10), // generate random id based on timestamp
+		ID:        newID(),
+		secret:    newID(),
+		identity:  identity,
+		ip:        ip,
 		room:      room,
 		conn:      conn,
-		send:      make(chan []byte, 256),
+		send:      newSendQueue(),
 		pc:        peerConnection,
 		inTracks:  make(map[uint32]*webrtc.Track),
 		outTracks: make(map[uint32]*webrtc.Track),
 		rtpCh:     make(chan *rtp.Packet, 100),
 
+		dataChannels: make(map[string]*webrtc.DataChannel),
+
+		signalLimiter: newTokenBucket(signalRate, signalBurst),
+		chatLimiter:   newTokenBucket(chatRate, chatBurst),
+		relayLimiter:  newTokenBucket(relayRate, relayBurst),
+		lastActive:    time.Now().UnixNano(),
+
 		info: UserInfo{
-			Emoji: emojis[rand.Intn(len(emojis))],
-			Mute:  true, // user is muted by default
+			Emoji:       emojis[rand.Intn(len(emojis))],
+			Mute:        true, // user is muted by default
+			Role:        roleUser,
+			Permissions: room.options.Permissions,
 		},
 	}
+	user.ApplyProfile(profile)
+	if claims != nil {
+		if claims.Name != "" {
+			user.info.Name = claims.Name
+			user.nameLocked = true
+		}
+		if claims.Permissions != nil {
+			user.info.Permissions = ParsePermissions(claims.Permissions)
+		}
+		if claims.Role == roleModerator {
+			user.info.Role = roleModerator
+			user.info.Permissions = allPermissions
+		}
+	} else if invite != nil {
+		if invite.Role == roleModerator {
+			user.info.Role = roleModerator
+			user.info.Permissions = allPermissions
+		}
+	} else if room.GetUsersCount() == 0 {
+		// the first user in the room moderates it
+		user.info.Role = roleModerator
+		user.info.Permissions = allPermissions
+	}
 
 	user.pc.OnICECandidate(func(iceCandidate *webrtc.ICECandidate) {
 		if iceCandidate != nil {
@@ -563,6 +881,7 @@ func serveWs(rooms *Rooms, w http.ResponseWriter, r *http.Request) {
 
 	user.pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
 		log.Printf("Connection State has changed %s \n", connectionState.String())
+		metrics.iceStates.Inc(connectionState.String())
 		if connectionState == webrtc.ICEConnectionStateConnected {
 			log.Println("user joined")
 			tracks := user.GetRoomTracks()
@@ -575,9 +894,9 @@ func serveWs(rooms *Rooms, w http.ResponseWriter, r *http.Request) {
 					panic(err)
 				}
 			}
-			err = user.SendOffer()
-			if err != nil {
-				panic(err)
+			// connection of lagging user may be closing already
+			if err := user.SendOffer(); err != nil && err != errChanClosed {
+				user.log(err)
 			}
 		} else if connectionState == webrtc.ICEConnectionStateDisconnected ||
 			connectionState == webrtc.ICEConnectionStateFailed ||
@@ -585,7 +904,7 @@ func serveWs(rooms *Rooms, w http.ResponseWriter, r *http.Request) {
 
 			user.stop = true
 			senders := user.pc.GetSenders()
-			for _, roomUser := range user.room.GetOtherUsers(user) {
+			for _, roomUser := range user.Room().GetOtherUsers(user) {
 				user.log("removing tracks from user")
 				for _, sender := range senders {
 					ssrc := sender.Track().SSRC()
@@ -605,40 +924,65 @@ func serveWs(rooms *Rooms, w http.ResponseWriter, r *http.Request) {
 		}
 	})
 
+	user.pc.OnDataChannel(user.HandleDataChannel)
+
 	user.pc.OnTrack(func(remoteTrack *webrtc.Track, receiver *webrtc.RTPReceiver) {
 		user.log(
 			"peerConnection.OnTrack",
 			fmt.Sprintf("track has started, of type %d: %s, ssrc: %d \n", remoteTrack.PayloadType(), remoteTrack.Codec().Name, remoteTrack.SSRC()),
 		)
-		if _, alreadyAdded := user.inTracks[remoteTrack.SSRC()]; alreadyAdded {
+		if !user.CanPublish() {
+			user.log("ignoring track from user without publish permission")
+			return
+		}
+		user.inTracksLock.Lock()
+		_, alreadyAdded := user.inTracks[remoteTrack.SSRC()]
+		if !alreadyAdded {
+			user.inTracks[remoteTrack.SSRC()] = remoteTrack
+		}
+		user.inTracksLock.Unlock()
+		if alreadyAdded {
 			user.log("user.inTrack != nil", "already handled")
 			return
 		}
 
-		user.inTracks[remoteTrack.SSRC()] = remoteTrack
-		for _, roomUser := range user.room.GetOtherUsers(user) {
-			log.Println("add remote track", fmt.Sprintf("(user: %s)", user.ID), "track to user ", roomUser.ID)
-			if err := roomUser.AddTrack(remoteTrack.SSRC()); err != nil {
-				log.Println(err)
-				continue
-			}
-			err := roomUser.SendOffer()
-			if err != nil {
-				panic(err)
-			}
-		}
+		user.publishTracks([]uint32{remoteTrack.SSRC()})
 		go user.receiveInTrackRTP(remoteTrack)
 		go user.broadcastIncomingRTP()
 	})
 
-	user.room.Join(user)
+	if identity != "" && sessionPolicy == sessionPolicyKickOld {
+		for _, session := range room.FindUsersByIdentity(identity) {
+			session.Kick(errConnectedElsewhere.Error())
+		}
+	}
+
+	waiting := false
+	for {
+		waiting = user.Room().options.Lobby && !user.IsModerator() && invite == nil
+		if waiting {
+			err = user.Room().EnterLobby(user)
+		} else {
+			err = user.Room().Join(user)
+		}
+		if err != errRoomClosed {
+			break
+		}
+		// room was removed while user was connecting
+		user.setRoom(rooms.GetOrCreate(roomID, ParseRoomOptions(r.URL.Query())))
+	}
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
 	go user.writePump()
 	go user.readPump()
 	go user.Watch()
+	go user.watchActivity()
 
 	user.SendEventUser()
+	if waiting {
+		user.Knock()
+		return
+	}
 	user.SendEventRoom()
 }